@@ -0,0 +1,197 @@
+package idx
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AggOp is the calculation made by an Agg.
+type AggOp int
+
+const (
+	AggCount AggOp = iota // number of documents, or of those holding the field
+	AggSum                // sum of the field's numeric values
+	AggAvg                // mean of the field's numeric values
+	AggMin                // smallest value of the field
+	AggMax                // largest value of the field
+)
+
+var aggNames = [...]string{"count", "sum", "avg", "min", "max"}
+
+func (op AggOp) String() string {
+	if op < 0 || int(op) >= len(aggNames) {
+		return "?"
+	}
+	return aggNames[op]
+}
+
+// Agg is an aggregate calculated over each group of documents by
+// Aggregate, from the field at a dot separated path into them, written
+// the same way as a Path. Values that can't take part, such as strings
+// in a sum, are skipped, as are documents without the field.
+type Agg struct {
+	Op    AggOp
+	Field string // empty to count every document
+	Name  string // name of the result, such as "sum(age)" if empty
+}
+
+func (a Agg) name() string {
+	switch {
+	case a.Name != "":
+		return a.Name
+	case a.Field == "":
+		return a.Op.String()
+	}
+	return fmt.Sprintf("%s(%s)", a.Op, a.Field)
+}
+
+// the running state of an aggregate over a group
+type tally struct {
+	n    int     // values seen
+	sum  float64 // of those that are numbers
+	nums int
+	best interface{} // smallest or largest value so far
+}
+
+func (t *tally) add(a Agg, v interface{}) {
+	if v == nil {
+		return
+	}
+	t.n++
+	if f, ok := number(v); ok {
+		t.sum += f
+		t.nums++
+	}
+	if a.Op == AggMin || a.Op == AggMax {
+		if t.n == 1 {
+			t.best = v
+		} else if c := order(v, true, t.best, true); a.Op == AggMin && c < 0 || a.Op == AggMax && c > 0 {
+			t.best = v
+		}
+	}
+}
+
+func (t *tally) result(a Agg) interface{} {
+	switch a.Op {
+	case AggCount:
+		return t.n
+	case AggSum:
+		return t.sum
+	case AggAvg:
+		if t.nums == 0 {
+			return nil
+		}
+		return t.sum / float64(t.nums)
+	}
+	return t.best
+}
+
+// Aggregate calculates aggs over the documents matching f (all of them
+// if f is nil), grouped by the values of the groupBy fields, and returns
+// a row for each group holding those fields and the aggregates, keyed
+// by their names. Rows are ordered by the group's values, the same way
+// ORDER BY sorts them, and documents without a groupBy field are
+// grouped under nil. Sums and averages are float64s, counts ints, and
+// the average, minimum and maximum of a group with no values are nil.
+//
+// Documents are read one at a time, so only the groups are held in
+// memory, and only the records f could match are read when it compares
+// fields covered by a Path index. Counting every document with no
+// filter or grouping reads no records at all, unless some of them
+// have a time to live. Anything more needs documents decoded into an
+// interface{}, so it fails with ErrNotDocument on stores using GobCodec
+// or RawCodec.
+func (st *Store) Aggregate(f Filter, groupBy []string, aggs ...Agg) ([]map[string]interface{}, error) {
+	type group struct {
+		by      []interface{}
+		tallies []tally
+	}
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return nil, ErrClosed
+	}
+	if f == nil && len(groupBy) == 0 && len(st.ttl) == 0 && counting(aggs) {
+		row, n := make(map[string]interface{}), 0
+		if c := st.index.Count(); c > 0 {
+			n = c
+		}
+		for _, a := range aggs {
+			row[a.name()] = n
+		}
+		return []map[string]interface{}{row}, nil
+	}
+
+	var paths [][]string
+	for _, a := range aggs {
+		paths = append(paths, Path(a.Field).parts())
+	}
+	groups := make(map[string]*group)
+	docs := f != nil || len(groupBy) > 0 || !counting(aggs)
+	if err := st.search(f, docs, func(h *hit) bool {
+		by := make([]interface{}, len(groupBy))
+		var id []byte
+		for i, field := range groupBy {
+			by[i], _ = lookup(h.doc, Path(field).parts())
+			b, ok := indexValue(by[i])
+			if !ok {
+				b = indexBytes(0xff, []byte(fmt.Sprintf("%#v", by[i])))
+			}
+			id = append(id, b...)
+		}
+		g, ok := groups[string(id)]
+		if !ok {
+			g = &group{by: by, tallies: make([]tally, len(aggs))}
+			groups[string(id)] = g
+		}
+		for i, a := range aggs {
+			if a.Field == "" {
+				g.tallies[i].add(a, true)
+			} else if v, ok := lookup(h.doc, paths[i]); ok {
+				g.tallies[i].add(a, v)
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(groupBy) == 0 && len(groups) == 0 {
+		// one group, even when nothing matched
+		groups[""] = &group{tallies: make([]tally, len(aggs))}
+	}
+	sorted := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		for k := range groupBy {
+			if c := order(sorted[i].by[k], true, sorted[j].by[k], true); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	rows := make([]map[string]interface{}, len(sorted))
+	for i, g := range sorted {
+		row := make(map[string]interface{}, len(groupBy)+len(aggs))
+		for k, field := range groupBy {
+			row[field] = g.by[k]
+		}
+		for k, a := range aggs {
+			row[a.name()] = g.tallies[k].result(a)
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// reports whether aggs only count documents
+func counting(aggs []Agg) bool {
+	for _, a := range aggs {
+		if a.Op != AggCount || a.Field != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// backup stream layout (all integers are big endian):
+//
+//	header:  magic[8] pagesize[4] codec[1] count[8]
+//	record:  page[4] length[4] data[length] crc32(data)[4]
+//	trailer: crc32(header and records)[4]
+//
+// backups made before codecs were added have no codec byte
+// and the older magic; they hold [key, value] documents
+var (
+	backupMagic   = []byte("IDXBAK02")
+	backupMagicV1 = []byte("IDXBAK01")
+)
+
+// snapshot tracks the pages a running backup still has to copy. writers
+// hand it the original contents of any of those pages before they change
+// them, so the backup sees the store exactly as it was when it started.
+type snapshot struct {
+	pending map[int]bool
+	saved   map[int][]byte
+}
+
+// preserve the current contents of page n for every running
+// backup that has yet to copy it; must be called with the lock
+// held, before the page is overwritten or freed
+func (st *Store) preserve(n int) error {
+	for snap := range st.backups {
+		if _, ok := snap.saved[n]; ok || !snap.pending[n] {
+			continue
+		}
+		b, err := st.engine.Get(n)
+		if err != nil {
+			return err
+		}
+		snap.saved[n] = b
+	}
+	return nil
+}
+
+// Backup writes a consistent point in time copy of the store to w. The
+// store is only locked briefly to take the snapshot and while each page
+// is copied, so writes carry on while the backup runs; any page they
+// touch is preserved until the backup has copied it.
+func (st *Store) Backup(w io.Writer) error {
+	st.Lock()
+	if st.closed {
+		st.Unlock()
+		return ErrClosed
+	}
+	snap := &snapshot{pending: make(map[int]bool), saved: make(map[int][]byte)}
+	var pages []int
+	for _, v := range st.index.All() {
+		n := int(Btoi(v))
+		pages = append(pages, n)
+		snap.pending[n] = true
+	}
+	st.backups[snap] = struct{}{}
+	done := st.scanning()
+	st.Unlock()
+	defer func() {
+		st.Lock()
+		delete(st.backups, snap)
+		done()
+		st.Unlock()
+	}()
+	sort.Ints(pages)
+
+	bw := bufio.NewWriter(w)
+	sum := crc32.NewIEEE()
+	out := io.MultiWriter(bw, sum)
+	hdr := make([]byte, 21)
+	copy(hdr, backupMagic)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(SYS_PAGE))
+	hdr[12] = st.codecID()
+	binary.BigEndian.PutUint64(hdr[13:], uint64(len(pages)))
+	if _, err := out.Write(hdr); err != nil {
+		return err
+	}
+	for _, n := range pages {
+		st.RLock()
+		b, ok := snap.saved[n]
+		var err error
+		if st.closed {
+			err = ErrClosed
+		} else if !ok {
+			b, err = st.engine.Get(n)
+		}
+		delete(snap.pending, n)
+		delete(snap.saved, n)
+		st.RUnlock()
+		if err != nil {
+			return err
+		}
+		if err := writeBackupRecord(out, n, b); err != nil {
+			return err
+		}
+	}
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], sum.Sum32())
+	if _, err := bw.Write(trailer[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// BackupTo writes a backup of the store to the file at path. The
+// backup is written to a temporary file which is synced and then
+// renamed into place, so path never holds a partial backup.
+func (st *Store) BackupTo(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := st.Backup(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore replaces the contents of the store with the backup read
+// from r. The whole backup is read and every checksum verified before
+// the store is touched, so a corrupt or truncated backup fails with
+// ErrBadBackup and leaves the store as it was. The backup must have
+// been taken from a store using the same codec. Snapshots taken
+// before the restore carry on seeing the store as it was.
+func (st *Store) Restore(r io.Reader) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	docs, codec, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	if codec != st.codecID() {
+		return fmt.Errorf("%w: backup uses codec %d, not %d", ErrCodec, codec, st.codecID())
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	defer st.scanning()()
+	var pages []int
+	if err := st.engine.Range(func(n int, _ []byte) bool {
+		pages = append(pages, n)
+		return true
+	}); err != nil {
+		return err
+	}
+	// every key, old or restored, changes as far as snapshots are concerned
+	keys := make([][]byte, len(docs))
+	var ops []*op
+	for i, doc := range docs {
+		if keys[i], err = st.key(doc); err != nil {
+			return err
+		}
+		ops = append(ops, &op{key: keys[i]})
+	}
+	st.index.Ascend(nil, func(r *Record) bool {
+		ops = append(ops, &op{key: r.Key})
+		return true
+	})
+	vs, err := st.retain(ops)
+	if err != nil {
+		return err
+	}
+	st.keep(vs)
+	for _, n := range pages {
+		if err := st.preserve(n); err != nil {
+			return err
+		}
+		if err := st.engine.Del(n); err != nil {
+			return err
+		}
+	}
+	st.index = NewTree()
+	st.ttl, st.expiring = make(map[string]int64), NewTree()
+	for i, doc := range docs {
+		k := keys[i]
+		n, err := st.engine.Add(doc)
+		if err != nil {
+			return err
+		}
+		st.index.Set(k, Itob(int64(n)))
+		st.track(k, doc)
+	}
+	for _, ix := range st.indexes {
+		if err := st.build(ix); err != nil {
+			return err
+		}
+	}
+	return st.engine.Sync()
+}
+
+// RestoreFrom restores the store from the backup file at path.
+func (st *Store) RestoreFrom(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return st.Restore(f)
+}
+
+func writeBackupRecord(w io.Writer, n int, b []byte) error {
+	buf := make([]byte, 8+len(b)+4)
+	binary.BigEndian.PutUint32(buf[0:], uint32(n))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(b)))
+	copy(buf[8:], b)
+	binary.BigEndian.PutUint32(buf[8+len(b):], crc32.ChecksumIEEE(b))
+	_, err := w.Write(buf)
+	return err
+}
+
+// read and verify a backup stream, returning the records
+// it holds and the id of the codec they were written with
+func readBackup(r io.Reader) ([][]byte, byte, error) {
+	br := bufio.NewReader(r)
+	sum := crc32.NewIEEE()
+	in := io.TeeReader(br, sum)
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(in, hdr); err != nil {
+		return nil, 0, fmt.Errorf("%w: header: %v", ErrBadBackup, err)
+	}
+	var codec byte
+	switch {
+	case bytes.Equal(hdr[:8], backupMagic):
+		var b [1]byte
+		if _, err := io.ReadFull(in, b[:]); err != nil {
+			return nil, 0, fmt.Errorf("%w: header: %v", ErrBadBackup, err)
+		}
+		codec = b[0]
+	case !bytes.Equal(hdr[:8], backupMagicV1):
+		return nil, 0, fmt.Errorf("%w: not a backup", ErrBadBackup)
+	}
+	if size := int(binary.BigEndian.Uint32(hdr[8:])); size != SYS_PAGE {
+		return nil, 0, fmt.Errorf("%w: page size %d, want %d", ErrBadBackup, size, SYS_PAGE)
+	}
+	var cnt [8]byte
+	if _, err := io.ReadFull(in, cnt[:]); err != nil {
+		return nil, 0, fmt.Errorf("%w: header: %v", ErrBadBackup, err)
+	}
+	count := binary.BigEndian.Uint64(cnt[:])
+	var docs [][]byte
+	for i := uint64(0); i < count; i++ {
+		var rec [8]byte
+		if _, err := io.ReadFull(in, rec[:]); err != nil {
+			return nil, 0, fmt.Errorf("%w: record %d: %v", ErrBadBackup, i, err)
+		}
+		n := binary.BigEndian.Uint32(rec[4:])
+		if int(n) > SYS_PAGE {
+			return nil, 0, fmt.Errorf("%w: record %d: length %d", ErrBadBackup, i, n)
+		}
+		b := make([]byte, n+4)
+		if _, err := io.ReadFull(in, b); err != nil {
+			return nil, 0, fmt.Errorf("%w: record %d: %v", ErrBadBackup, i, err)
+		}
+		if crc32.ChecksumIEEE(b[:n]) != binary.BigEndian.Uint32(b[n:]) {
+			return nil, 0, fmt.Errorf("%w: record %d: checksum mismatch", ErrBadBackup, i)
+		}
+		docs = append(docs, b[:n])
+	}
+	want := sum.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(br, trailer[:]); err != nil {
+		return nil, 0, fmt.Errorf("%w: trailer: %v", ErrBadBackup, err)
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != want {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", ErrBadBackup)
+	}
+	return docs, codec, nil
+}
@@ -0,0 +1,214 @@
+package idx
+
+// a single change to a store
+type op struct {
+	key []byte
+	rec []byte // framed record to write, or nil to delete the key
+}
+
+// Batch collects writes that are applied to a store together.
+type Batch struct {
+	st  *Store
+	ops []*op
+}
+
+// Put adds or updates a key value pair in the batch. The value is
+// encoded straight away, so encoding errors are reported here.
+func (b *Batch) Put(k []byte, v interface{}) error {
+	rec, err := b.st.record(k, v)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, &op{key: append([]byte(nil), k...), rec: rec})
+	return nil
+}
+
+// Delete removes a key from the store when the batch is applied.
+func (b *Batch) Delete(k []byte) {
+	b.ops = append(b.ops, &op{key: append([]byte(nil), k...)})
+}
+
+// Batch calls fn to fill a batch of writes and then applies all of
+// them under a single lock acquisition and a single durability
+// barrier. If fn returns an error nothing is written. The batch is
+// applied all or nothing: should applying it fail, the changes made
+// so far are rolled back, and should the process crash part way
+// through, the journal completes the batch when the store is next
+// opened.
+func (st *Store) Batch(fn func(b *Batch) error) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	b := &Batch{st: st}
+	if err := fn(b); err != nil {
+		return err
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.commit(b.ops)
+}
+
+// apply a set of changes as a unit; must be called with the lock held
+func (st *Store) commit(ops []*op) error {
+	if err := st.stamp(ops); err != nil {
+		return err
+	}
+	var evs []Event
+	if st.watched() {
+		var err error
+		if evs, err = st.events(ops); err != nil {
+			return err
+		}
+	}
+	vs, err := st.retain(ops)
+	if err != nil {
+		return err
+	}
+	if err := st.write(ops); err != nil {
+		return err // nothing changed
+	}
+	st.keep(vs)
+	st.publish(evs)
+	return st.settle(ops)
+}
+
+// write a set of changes as a unit, leaving the store as it was if any
+// of them fails; must be called with the lock held
+func (st *Store) write(ops []*op) error {
+	if len(ops) == 1 {
+		// a single change either happens or it doesn't
+		return st.apply(ops[0])
+	}
+	// once journaled, a batch is rolled forward if the store goes down
+	// part way through, so it mustn't be one that can't be applied
+	if err := st.precheck(ops); err != nil {
+		return err
+	}
+	if st.journal != nil {
+		if err := st.journal.write(ops); err != nil {
+			return err
+		}
+	}
+	undo := make([]*op, 0, len(ops))
+	for _, o := range ops {
+		old, err := st.current(o.key)
+		if err == nil {
+			err = st.apply(o)
+		}
+		if err != nil {
+			st.rollback(undo)
+			if st.journal != nil {
+				st.journal.clear()
+			}
+			return err
+		}
+		undo = append(undo, &op{key: o.key, rec: old})
+	}
+	return nil
+}
+
+// make written changes durable; must be called with the lock held
+func (st *Store) settle(ops []*op) error {
+	if len(ops) == 1 || st.journal == nil {
+		return st.barrier()
+	}
+	if err := st.engine.Sync(); err != nil {
+		return err // the journal rolls it forward on the next open
+	}
+	return st.journal.clear()
+}
+
+// undo changes that were applied, newest first
+func (st *Store) rollback(undo []*op) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		st.apply(undo[i]) // best effort
+	}
+}
+
+// returns the record currently stored for a key, or nil
+func (st *Store) current(k []byte) ([]byte, error) {
+	if r := st.index.Get(k); r != nil {
+		return st.engine.Get(int(Btoi(r.Val)))
+	}
+	return nil, nil
+}
+
+// write or delete a single record and update the indexes to match
+func (st *Store) apply(o *op) error {
+	if len(st.indexes) == 0 {
+		return st.put(o)
+	}
+	old, err := st.current(o.key)
+	if err != nil {
+		return err
+	}
+	ri, err := st.reindex(o.key, old, o.rec)
+	if err != nil {
+		return err
+	}
+	if err := ri.check(o.key, st.expired); err != nil {
+		return err
+	}
+	if err := st.put(o); err != nil {
+		return err
+	}
+	ri.apply(o.key)
+	return nil
+}
+
+// write or delete a single record and update the primary index to match
+func (st *Store) put(o *op) error {
+	r := st.index.Get(o.key)
+	if r != nil {
+		n := int(Btoi(r.Val))
+		if err := st.preserve(n); err != nil {
+			return err
+		}
+		if o.rec != nil {
+			if err := st.engine.Set(n, o.rec); err != nil {
+				return err
+			}
+			st.track(o.key, o.rec)
+			return nil
+		}
+		// free (and zero) the page as well, otherwise the
+		// record comes back the next time the store is opened
+		if err := st.engine.Del(n); err != nil {
+			return err
+		}
+		st.index.Del(o.key)
+		st.track(o.key, nil)
+		return nil
+	}
+	if o.rec == nil {
+		return nil // nothing to delete
+	}
+	n, err := st.engine.Add(o.rec)
+	if err != nil {
+		return err
+	}
+	st.index.Set(o.key, Itob(int64(n)))
+	st.track(o.key, o.rec)
+	return nil
+}
+
+// roll forward a commit left in the journal by a crash, as read from it
+func (st *Store) recover(ops []*op) error {
+	for _, o := range ops {
+		if err := st.apply(o); err != nil {
+			return err
+		}
+	}
+	if len(ops) > 0 {
+		if err := st.engine.Sync(); err != nil {
+			return err
+		}
+	}
+	return st.journal.clear()
+}
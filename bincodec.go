@@ -0,0 +1,479 @@
+package idx
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// BinaryCodec layout: every value starts with a one byte tag,
+//
+//	nil, false, true
+//	int    zigzag varint
+//	uint   uvarint
+//	float  ieee 754 bits[8]
+//	string length[uvarint] data
+//	bytes  length[uvarint] data
+//	list   count[uvarint] values
+//	map    count[uvarint] key value pairs
+//
+// structs are written as maps keyed by field name (or json tag name),
+// and anything implementing encoding.BinaryMarshaler, like time.Time,
+// as bytes.
+const (
+	binNil byte = iota
+	binFalse
+	binTrue
+	binInt
+	binUint
+	binFloat
+	binString
+	binBytes
+	binList
+	binMap
+)
+
+var (
+	errBinShort = errors.New("binary codec: value is truncated")
+
+	binMarshaler   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+type binaryCodec struct{}
+
+func (binaryCodec) ID() byte { return 4 }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	return binEncode(nil, reflect.ValueOf(v))
+}
+
+func (binaryCodec) Unmarshal(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrNonPtrVal
+	}
+	d := &binDecoder{b: b}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if len(d.b) > 0 {
+		return errors.New("binary codec: trailing data after value")
+	}
+	return nil
+}
+
+func binEncode(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, binNil), nil
+	}
+	if v.Type().Implements(binMarshaler) && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return binBlob(b, binBytes, data), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return append(b, binNil), nil
+		}
+		return binEncode(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, binTrue), nil
+		}
+		return append(b, binFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(append(b, binInt), v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(append(b, binUint), v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(b, binFloat), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return binBlob(b, binString, []byte(v.String())), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(b, binNil), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			return binBlob(b, binBytes, data), nil
+		}
+		b = binary.AppendUvarint(append(b, binList), uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = binEncode(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, binNil), nil
+		}
+		b = binary.AppendUvarint(append(b, binMap), uint64(v.Len()))
+		for it := v.MapRange(); it.Next(); {
+			var err error
+			if b, err = binEncode(b, it.Key()); err != nil {
+				return nil, err
+			}
+			if b, err = binEncode(b, it.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		fields := binFields(v.Type())
+		b = binary.AppendUvarint(append(b, binMap), uint64(len(fields)))
+		for name, i := range fields {
+			b = binBlob(b, binString, []byte(name))
+			var err error
+			if b, err = binEncode(b, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("binary codec cannot encode %s", v.Type())
+}
+
+func binBlob(b []byte, tag byte, data []byte) []byte {
+	return append(binary.AppendUvarint(append(b, tag), uint64(len(data))), data...)
+}
+
+// the exported fields of a struct by the name they are encoded under
+func binFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+type binDecoder struct {
+	b []byte
+}
+
+func (d *binDecoder) tag() (byte, error) {
+	if len(d.b) == 0 {
+		return 0, errBinShort
+	}
+	t := d.b[0]
+	d.b = d.b[1:]
+	return t, nil
+}
+
+func (d *binDecoder) uvarint() (uint64, error) {
+	n, i := binary.Uvarint(d.b)
+	if i <= 0 {
+		return 0, errBinShort
+	}
+	d.b = d.b[i:]
+	return n, nil
+}
+
+func (d *binDecoder) varint() (int64, error) {
+	n, i := binary.Varint(d.b)
+	if i <= 0 {
+		return 0, errBinShort
+	}
+	d.b = d.b[i:]
+	return n, nil
+}
+
+// reads a count or length, which can't be more than the bytes left
+func (d *binDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.b)) {
+		return 0, errBinShort
+	}
+	return int(n), nil
+}
+
+func (d *binDecoder) blob() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	data := d.b[:n]
+	d.b = d.b[n:]
+	return data, nil
+}
+
+func (d *binDecoder) float() (float64, error) {
+	if len(d.b) < 8 {
+		return 0, errBinShort
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return f, nil
+}
+
+// decode the next value into v, which must be settable
+func (d *binDecoder) decode(v reflect.Value) error {
+	if len(d.b) == 0 {
+		return errBinShort
+	}
+	tag := d.b[0]
+	if tag == binNil {
+		d.b = d.b[1:]
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if tag == binBytes && v.CanAddr() && v.Addr().Type().Implements(binUnmarshaler) {
+		d.b = d.b[1:]
+		data, err := d.blob()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			x, err := d.any()
+			if err != nil {
+				return err
+			}
+			if x == nil {
+				v.Set(reflect.Zero(v.Type()))
+			} else {
+				v.Set(reflect.ValueOf(x))
+			}
+			return nil
+		}
+	}
+	d.b = d.b[1:]
+	switch tag {
+	case binFalse, binTrue:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(tag == binTrue)
+			return nil
+		}
+	case binInt, binUint:
+		var i int64
+		var u uint64
+		var err error
+		if tag == binInt {
+			i, err = d.varint()
+			u = uint64(i)
+		} else {
+			u, err = d.uvarint()
+			i = int64(u)
+		}
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.OverflowInt(i) || tag == binUint && i < 0 {
+				break
+			}
+			v.SetInt(i)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if v.OverflowUint(u) || tag == binInt && i < 0 {
+				break
+			}
+			v.SetUint(u)
+			return nil
+		case reflect.Float32, reflect.Float64:
+			if tag == binInt {
+				v.SetFloat(float64(i))
+			} else {
+				v.SetFloat(float64(u))
+			}
+			return nil
+		}
+	case binFloat:
+		f, err := d.float()
+		if err != nil {
+			return err
+		}
+		if k := v.Kind(); k == reflect.Float32 || k == reflect.Float64 {
+			v.SetFloat(f)
+			return nil
+		}
+	case binString, binBytes:
+		data, err := d.blob()
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(data))
+			return nil
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), data...))
+			return nil
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			reflect.Copy(v, reflect.ValueOf(data))
+			return nil
+		}
+	case binList:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		case reflect.Array:
+			v.Set(reflect.Zero(v.Type()))
+		default:
+			return fmt.Errorf("binary codec cannot decode a list into %s", v.Type())
+		}
+		for i := 0; i < n; i++ {
+			if i < v.Len() {
+				err = d.decode(v.Index(i))
+			} else {
+				_, err = d.any() // more elements than the array holds
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case binMap:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			if v.IsNil() {
+				v.Set(reflect.MakeMapWithSize(v.Type(), n))
+			}
+			for i := 0; i < n; i++ {
+				key, val := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+				if err := d.decode(key); err != nil {
+					return err
+				}
+				if err := d.decode(val); err != nil {
+					return err
+				}
+				v.SetMapIndex(key, val)
+			}
+			return nil
+		case reflect.Struct:
+			fields := binFields(v.Type())
+			for i := 0; i < n; i++ {
+				var name string
+				if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+					return err
+				}
+				if f, ok := fields[name]; ok {
+					err = d.decode(v.Field(f))
+				} else {
+					_, err = d.any() // skip fields the struct doesn't have
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("binary codec cannot decode a map into %s", v.Type())
+	default:
+		return fmt.Errorf("binary codec: unknown tag %d", tag)
+	}
+	return fmt.Errorf("binary codec cannot decode tag %d into %s", tag, v.Type())
+}
+
+// decode the next value into the natural go type for it: int64,
+// uint64, float64, string, []byte, []interface{}, or a map, which
+// is a map[string]interface{} when all of its keys are strings
+func (d *binDecoder) any() (interface{}, error) {
+	tag, err := d.tag()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case binNil:
+		return nil, nil
+	case binFalse, binTrue:
+		return tag == binTrue, nil
+	case binInt:
+		return d.varint()
+	case binUint:
+		return d.uvarint()
+	case binFloat:
+		return d.float()
+	case binString:
+		data, err := d.blob()
+		return string(data), err
+	case binBytes:
+		data, err := d.blob()
+		return append([]byte(nil), data...), err
+	case binList:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = d.any(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case binMap:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		keys, vals := make([]interface{}, n), make([]interface{}, n)
+		strs := true
+		for i := 0; i < n; i++ {
+			if keys[i], err = d.any(); err != nil {
+				return nil, err
+			}
+			if vals[i], err = d.any(); err != nil {
+				return nil, err
+			}
+			_, ok := keys[i].(string)
+			strs = strs && ok
+		}
+		if strs {
+			m := make(map[string]interface{}, n)
+			for i, k := range keys {
+				m[k.(string)] = vals[i]
+			}
+			return m, nil
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i, k := range keys {
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, fmt.Errorf("binary codec: map key of type %T", k)
+			}
+			m[k] = vals[i]
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("binary codec: unknown tag %d", tag)
+}
@@ -0,0 +1,94 @@
+package idx
+
+var tbl = [16]byte{0, 1, 1, 2, 1, 2, 2, 3, 1, 2, 2, 3, 2, 3, 3, 4}
+
+// maximum number of pages a bitmap can track; the last
+// two bytes of the bitmap region are never used for bits
+const MAXPAGES = 524272
+
+// bitmap tracks which pages are in use, one bit per page. it
+// is stored in the first DATAOFFSET bytes of every data file
+type bitmap []byte
+
+func (bm bitmap) has(k int) bool {
+	if k < 0 || k >= MAXPAGES {
+		return false
+	}
+	return (bm[k/8] & (1 << (uint(k % 8)))) != 0
+}
+
+func (bm bitmap) add() int {
+	if k := bm.next(); k != -1 {
+		bm.set(k) // add
+		return k
+	}
+	return -1
+}
+
+func (bm bitmap) set(k int) {
+	// flip the n-th bit on; add/set
+	bm[k/8] |= (1 << uint(k%8))
+}
+
+func (bm bitmap) del(k int) {
+	// flip the k-th bit off; delete
+	bm[k/8] &= ^(1 << uint(k%8))
+}
+
+func bits(n byte) int {
+	return int(tbl[n>>4] + tbl[n&0x0f])
+}
+
+// returns the lowest free page, or -1 if there are none
+func (bm bitmap) next() int {
+	for i := 0; i < (MAXPAGES / 8); i++ {
+		if bits(bm[i]) < 8 {
+			for j := 0; j < 8; j++ {
+				cur := (i * 8) + j
+				if !bm.has(cur) {
+					return cur
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// returns the highest page in use, or -1 if there are none
+func (bm bitmap) last() int {
+	for i := (MAXPAGES / 8) - 1; i >= 0; i-- {
+		if bm[i] != 0x00 {
+			for j := 7; j >= 0; j-- {
+				if cur := (i * 8) + j; bm.has(cur) {
+					return cur
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// returns the number of pages in use
+func (bm bitmap) used() int {
+	var used int
+	for i := 0; i < (MAXPAGES / 8); i++ {
+		used += bits(bm[i])
+	}
+	return used
+}
+
+// returns every page in use, in order
+func (bm bitmap) all() []int {
+	var all []int
+	for i := 0; i < (MAXPAGES / 8); i++ {
+		if bm[i] != 0x00 {
+			for j := 0; j < 8; j++ {
+				cur := (i * 8) + j
+				if bm.has(cur) {
+					all = append(all, cur)
+				}
+			}
+		}
+	}
+	return all
+}
@@ -371,6 +371,37 @@ func (t *Tree) Get(key []byte) *Record {
 	return n.ptrs[i].(*Record)
 }
 
+// Seek returns the first record whose key is greater
+// than or equal to the provided key, or nil if none is
+func (t *Tree) Seek(key []byte) *Record {
+	n := findLeaf(t.root, key)
+	for n != nil {
+		for i := 0; i < n.numKeys; i++ {
+			if bytes.Compare(n.keys[i], key) >= 0 {
+				return n.ptrs[i].(*Record)
+			}
+		}
+		// follow pointer to next leaf node
+		n, _ = n.ptrs[ORDER-1].(*node)
+	}
+	return nil
+}
+
+// Ascend calls fn for every record whose key is greater than or
+// equal to start, in key order, until fn returns false. The tree
+// must not be modified until Ascend returns.
+func (t *Tree) Ascend(start []byte, fn func(r *Record) bool) {
+	n := findLeaf(t.root, start)
+	for n != nil {
+		for i := 0; i < n.numKeys; i++ {
+			if bytes.Compare(n.keys[i], start) >= 0 && !fn(n.ptrs[i].(*Record)) {
+				return
+			}
+		}
+		n, _ = n.ptrs[ORDER-1].(*node)
+	}
+}
+
 func find(root *node, key []byte) *Record {
 	//n := findLeaf(root, key)
 
@@ -0,0 +1,104 @@
+package idx
+
+import "time"
+
+// GetVersion decodes the value for a key into ptr, just as Get would,
+// and returns the record's version. Every write, by any means, gives
+// a record a new version higher than any the store has given out
+// before, so a key never has the same version twice, even if it is
+// deleted and added back; versions are not consecutive. A nil ptr
+// just returns the version.
+func (st *Store) GetVersion(k []byte, ptr interface{}) (uint64, error) {
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return 0, ErrClosed
+	}
+	rec, err := st.current(k)
+	if err != nil {
+		return 0, err
+	}
+	if rec == nil || st.expired(k) {
+		return 0, ErrNotFound
+	}
+	h, err := parseRecord(rec)
+	if err != nil {
+		return 0, err
+	}
+	if ptr != nil {
+		if err := st.unmarshal(rec, ptr); err != nil {
+			return 0, err
+		}
+	}
+	return h.version, nil
+}
+
+// SetIf adds or updates a key value pair, but only if the key's version
+// is still expected, as returned by GetVersion; an expected version of
+// 0 only adds the key if it doesn't exist. Otherwise it fails with
+// ErrVersionMismatch and nothing is written.
+func (st *Store) SetIf(k []byte, v interface{}, expected uint64) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	rec, err := st.record(k, v)
+	if err != nil {
+		return err
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	cur, err := st.versionOf(k)
+	if err != nil {
+		return err
+	}
+	if cur != expected {
+		return ErrVersionMismatch
+	}
+	return st.commit([]*op{{key: k, rec: rec}})
+}
+
+// the version of the record held for k, or 0 if there
+// isn't one; must hold the lock
+func (st *Store) versionOf(k []byte) (uint64, error) {
+	if st.expired(k) {
+		return 0, nil
+	}
+	rec, err := st.current(k)
+	if err != nil || rec == nil {
+		return 0, err
+	}
+	h, err := parseRecord(rec)
+	if err != nil {
+		return 0, err
+	}
+	return h.version, nil
+}
+
+// give every record about to be written the next version from the
+// store's counter; must hold the lock
+func (st *Store) stamp(ops []*op) error {
+	for _, o := range ops {
+		if o.rec == nil {
+			continue
+		}
+		st.vmax++
+		rec, err := st.restamp(o.rec, st.vmax)
+		if err != nil {
+			return err
+		}
+		o.rec = rec
+	}
+	return nil
+}
+
+// start the version counter from the clock if it is ahead of every
+// record held, so versions keep going up across restarts even once
+// the records holding the highest ones have been deleted
+func (st *Store) seedVersion() {
+	if now := uint64(time.Now().UnixNano()); now > st.vmax {
+		st.vmax = now
+	}
+}
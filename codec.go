@@ -0,0 +1,201 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes the values held by a store. Every codec has an id that
+// is recorded in the data file header, so a store always reopens with
+// the codec it was created with. Ids 1 to 127 are reserved for the
+// built in codecs; stores using any other codec must be opened with
+// it set in their Options.
+type Codec interface {
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes values with encoding/gob. Values must be
+	// decoded into the same type they were encoded from, so they
+	// can't be filtered, ordered, aggregated over or indexed.
+	GobCodec Codec = gobCodec{}
+
+	// RawCodec stores []byte and string values as they are, and
+	// decodes them into a *[]byte or *string. Like GobCodec values,
+	// they can't be filtered, ordered, aggregated over or indexed.
+	RawCodec Codec = rawCodec{}
+
+	// BinaryCodec encodes values in a compact, self describing binary
+	// format. Unlike JSON it keeps integers and byte slices intact, so
+	// an int64 decoded into an interface{} comes back as an int64.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// built in codecs by id
+var codecs = map[byte]Codec{
+	1: JSONCodec,
+	2: GobCodec,
+	3: RawCodec,
+	4: BinaryCodec,
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte                                { return 1 }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte { return 2 }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) ID() byte { return 3 }
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("raw codec cannot encode %T", v)
+}
+
+func (rawCodec) Unmarshal(b []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), b...)
+	case *string:
+		*v = string(b)
+	default:
+		return fmt.Errorf("raw codec cannot decode into %T", v)
+	}
+	return nil
+}
+
+// decide which codec the store encodes values with, recording it in the
+// engine's header if the store is new; must be called before load
+func (st *Store) setCodec() error {
+	want := st.opts.Codec
+	if want != nil && want.ID() == 0 {
+		return fmt.Errorf("%w: codec id 0 is reserved", ErrCodec)
+	}
+	h, ok := st.engine.(Headerer)
+	if !ok {
+		st.codec = want // nowhere to record it
+		return nil
+	}
+	hdr := h.Header()
+	switch id := hdr[0]; {
+	case id == 0 && want != nil:
+		// only a store with no records yet can take on a codec
+		empty := true
+		if err := st.engine.Range(func(int, []byte) bool {
+			empty = false
+			return false
+		}); err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("%w: store holds [key, value] documents", ErrCodec)
+		}
+		if !st.opts.ReadOnly {
+			hdr[0] = want.ID()
+			if err := h.SetHeader(hdr); err != nil {
+				return err
+			}
+		}
+	case id != 0 && want == nil:
+		if want = codecs[id]; want == nil {
+			return fmt.Errorf("%w: store uses unknown codec %d", ErrCodec, id)
+		}
+	case id != 0 && want.ID() != id:
+		return fmt.Errorf("%w: store uses codec %d, not %d", ErrCodec, id, want.ID())
+	}
+	st.codec = want
+	return nil
+}
+
+// id of the store's codec, 0 for [key, value] documents
+func (st *Store) codecID() byte {
+	if st.codec == nil {
+		return 0
+	}
+	return st.codec.ID()
+}
+
+// reports whether values can be decoded into an interface{} as the
+// documents filters and indexes work with; gob and raw values can
+// only be decoded into the types they were written from
+func (st *Store) documents() bool {
+	id := st.codecID()
+	return id != GobCodec.ID() && id != RawCodec.ID()
+}
+
+// encode a key value pair as a document; without a codec that is
+// a JSON [key, value] array, otherwise it is the length of the key
+// as a uvarint followed by the key and the encoded value
+func (st *Store) pack(k []byte, v interface{}) ([]byte, error) {
+	if st.codec == nil {
+		return encode(string(k), v)
+	}
+	val, err := st.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(k)+len(val))
+	doc = append(doc[:binary.PutUvarint(doc, uint64(len(k)))], k...)
+	return append(doc, val...), nil
+}
+
+// decode just the value held by a record into ptr; unlike unmarshal,
+// which hands back the whole [key, value] array for stores without
+// a codec, this always decodes the value alone
+func (st *Store) value(rec []byte, ptr interface{}) error {
+	if st.codec != nil {
+		return st.unmarshal(rec, ptr)
+	}
+	doc, err := st.unframe(rec)
+	if err != nil {
+		return err
+	}
+	var kv []json.RawMessage
+	if err := json.Unmarshal(doc, &kv); err != nil {
+		return err
+	}
+	if len(kv) < 2 {
+		return ErrBadRecord
+	}
+	return decode(kv[1], ptr)
+}
+
+// split a document written with a codec into its key and value
+func unpack(doc []byte) ([]byte, []byte, error) {
+	n, i := binary.Uvarint(doc)
+	if i <= 0 || uint64(len(doc)-i) < n {
+		return nil, nil, ErrBadRecord
+	}
+	return doc[i : i+int(n)], doc[i+int(n):], nil
+}
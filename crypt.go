@@ -0,0 +1,144 @@
+package idx
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyProvider supplies the keys used to encrypt records at rest. Every
+// key has an id, which is stored in the header of each record it is
+// used for, so keys can be rotated: new records are written with the
+// current key while older ones are still read with the key they were
+// written with. Keys must be 16, 24 or 32 bytes (AES-128, -192, -256).
+type KeyProvider interface {
+
+	// returns the id and key to encrypt new records with
+	CurrentKey() (uint32, []byte, error)
+
+	// returns the key with the given id
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider backed by a fixed set of keys.
+type StaticKeys struct {
+	Current uint32            // id of the key used for new records
+	Keys    map[uint32][]byte // every known key by id
+}
+
+func (sk *StaticKeys) CurrentKey() (uint32, []byte, error) {
+	k, err := sk.Key(sk.Current)
+	return sk.Current, k, err
+}
+
+func (sk *StaticKeys) Key(id uint32) ([]byte, error) {
+	if k, ok := sk.Keys[id]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrNoKey, id)
+}
+
+// size of the key id and nonce added to the header of an encrypted record
+const recCryptExt = 4 + 12
+
+// seal payload with the current key using AES-GCM. the returned header
+// extension holds the key id and nonce; hdr (the record header) and the
+// extension are authenticated along with the payload
+func (st *Store) seal(hdr, payload []byte) ([]byte, []byte, error) {
+	id, key, err := st.opts.Keys.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ext := make([]byte, recCryptExt)
+	binary.BigEndian.PutUint32(ext, id)
+	if _, err := rand.Read(ext[4:]); err != nil {
+		return nil, nil, err
+	}
+	return ext, gcm.Seal(nil, ext[4:], payload, append(hdr, ext...)), nil
+}
+
+// open an encrypted payload; ad is the authenticated header data
+// and ext the key id and nonce stored in the header
+func (st *Store) open(ad, ext, payload []byte) ([]byte, error) {
+	if st.opts.Keys == nil {
+		return nil, ErrNoKey
+	}
+	key, err := st.opts.Keys.Key(binary.BigEndian.Uint32(ext))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := gcm.Open(nil, ext[4:recCryptExt], payload, ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRecord, err)
+	}
+	return b, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Rekey rewrites every record that is not encrypted with the current
+// key, for instance after the KeyProvider has been rotated, so that
+// older keys can eventually be retired.
+func (st *Store) Rekey() error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if st.opts.Keys == nil {
+		return ErrNoKey
+	}
+	id, _, err := st.opts.Keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	defer st.scanning()()
+	for _, v := range st.index.All() {
+		n := int(Btoi(v))
+		b, err := st.engine.Get(n)
+		if err != nil {
+			return err
+		}
+		h, err := parseRecord(b)
+		if err != nil {
+			return err
+		}
+		if h.flags&recCrypt != 0 && h.keyID == id {
+			continue
+		}
+		doc, err := st.unframe(b)
+		if err != nil {
+			return err
+		}
+		rec, err := st.frame(doc, h.meta)
+		if err != nil {
+			return err
+		}
+		if err := st.preserve(n); err != nil {
+			return err
+		}
+		if err := st.engine.Set(n, rec); err != nil {
+			return err
+		}
+	}
+	return st.barrier()
+}
@@ -1,200 +1,471 @@
 package idx
 
 import (
-	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
-var (
-	nilPage = make([]byte, SYS_PAGE)
-	tbl     = [16]byte{0, 1, 1, 2, 1, 2, 2, 3, 1, 2, 2, 3, 2, 3, 3, 4}
-)
+var nilPage = make([]byte, SYS_PAGE)
 
 const (
 	DATAOFFSET = 65536
+
+	// size of the file header, which sits in the
+	// bytes at the end of the bitmap it never uses
+	HEADERSIZE = DATAOFFSET - MAXPAGES/8
 )
 
 type MappedData struct {
-	path string
-	file *os.File
-	size int
-	used int
-	mmap Data
+	path     string
+	file     *os.File
+	size     int
+	used     int
+	mmap     Data
+	dirty    map[int]struct{} // system pages written since the last sync, if tracked
+	readOnly bool
+	advice   int32 // last access hint given, re-applied whenever we remap
+
+	flushing  sync.WaitGroup // flushes still waiting on the disk, see Flush
+	flushmu   sync.Mutex     // guards unflushed
+	unflushed []int          // dirty pages given back by flushes that failed
 }
 
 // open a mapped file, or create if needed and align the
 // size to the minimum memory mapped file size (ie. 16 MB)
-func OpenMappedData(path string) *MappedData {
-	file, path, size := OpenFile(path + ".dat")
+func OpenMappedData(path string) (*MappedData, error) {
+	return OpenMappedDataWith(path, nil)
+}
+
+// open a mapped file using the supplied options. when opened
+// read only the file must already exist, it is mapped without
+// write access and every mutating method returns ErrReadOnly
+func OpenMappedDataWith(path string, opts *Options) (*MappedData, error) {
+	o := opts.withDefaults()
+	open, mmap := OpenFile, Mmap
+	if o.ReadOnly {
+		open, mmap = OpenFileReadOnly, MmapReadOnly
+	}
+	file, path, size, err := open(path + ".dat")
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(file, !o.ReadOnly, o.LockTimeout); err != nil {
+		file.Close()
+		return nil, err
+	}
 	if size == 0 {
-		size = resize(file.Fd(), 1<<24) // start size 16MB
+		if o.ReadOnly {
+			file.Close()
+			return nil, fmt.Errorf("%s: empty data file", file.Name())
+		}
+		size, err = resize(file, 1<<24) // start size 16MB
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	data, err := mmap(file, 0, size)
+	if err != nil {
+		file.Close()
+		return nil, err
 	}
 	md := &MappedData{
-		path: path + ".dat",
-		file: file,
-		size: size,
-		mmap: Mmap(file, 0, size),
+		path:     path + ".dat",
+		file:     file,
+		size:     size,
+		mmap:     data,
+		readOnly: o.ReadOnly,
+		advice:   syscall.MADV_NORMAL,
+	}
+	if o.Durability != DurabilityNone {
+		// only worth tracking if the pages are going to be synced
+		md.dirty = make(map[int]struct{})
 	}
-	md.bitMapUsed()
-	return md
+	md.used = md.bitmap().used()
+	return md, nil
 }
 
 // updates existing or inserts new block at offset n
-func (md *MappedData) Add(b []byte) int {
-	md.checkGrow()
-	n := md.bitMapAdd()
+func (md *MappedData) Add(b []byte) (int, error) {
+	if md.readOnly {
+		return -1, ErrReadOnly
+	}
+	if md.mmap == nil {
+		return -1, ErrUnmapped
+	}
+	if err := md.checkGrow(md.used); err != nil {
+		return -1, err
+	}
+	n := md.bitmap().add()
 	if n == -1 {
-		return -1
+		return -1, ErrStoreFull
 	}
 	// new position has been set in bitmap
 	pos := getOffset(n)
 	copy(md.mmap[pos:pos+SYS_PAGE], b)
 	md.used++
-	return n
+	md.touch(n)
+	return n, nil
 }
 
 // updates existing or inserts new block at offset n
-func (md *MappedData) Set(n int, b []byte) {
-	md.checkGrow()
+func (md *MappedData) Set(n int, b []byte) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	if md.mmap == nil {
+		return ErrUnmapped
+	}
+	if n < 0 || n >= MAXPAGES {
+		return ErrStoreFull
+	}
+	if err := md.checkGrow(n); err != nil {
+		return err
+	}
 	pos := getOffset(n)
-	if !md.bitMapHas(n) {
+	if !md.bitmap().has(n) {
 		md.used++ // we are adding
-		md.bitMapSet(n)
+		md.bitmap().set(n)
 	} else {
 		//copy(nilPage, b) // wipe existing record data
 		copy(md.mmap[pos:pos+SYS_PAGE], nilPage)
 	}
 	// otherwise we are just updating
 	copy(md.mmap[pos:pos+SYS_PAGE], b)
+	md.touch(n)
+	return nil
 }
 
 // returns block at offset n
-func (md *MappedData) Get(n int) []byte {
-	if md.bitMapHas(n) {
+func (md *MappedData) Get(n int) ([]byte, error) {
+	if md.mmap == nil {
+		return nil, ErrUnmapped
+	}
+	if md.bitmap().has(n) {
 		pos := getOffset(n)
-		return strip(md.mmap[pos : pos+SYS_PAGE])
+		// hand out a copy; the mapping moves whenever the file is resized
+		return append([]byte(nil), strip(md.mmap[pos:pos+SYS_PAGE])...), nil
 	}
-	return nil
+	return nil, nil
 }
 
 // removes block at offset n
-func (md *MappedData) Del(n int) {
-	if md.bitMapHas(n) {
-		md.bitMapDel(n)
+func (md *MappedData) Del(n int) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	if md.mmap == nil {
+		return ErrUnmapped
+	}
+	if md.bitmap().has(n) {
+		md.bitmap().del(n)
 		pos := getOffset(n)
 		copy(md.mmap[pos:pos+SYS_PAGE], nilPage)
 		md.used--
+		md.touch(n)
 	}
+	return nil
 }
 
-func (md *MappedData) All() map[string]int {
-	m := make(map[string]int)
-	v := []interface{}{}
-	for _, page := range md.bitMapAll() {
-		b := md.Get(page)
-		if err := json.Unmarshal(b, &v); err != nil {
-			panic(err)
+// calls fn for every page in use, in page order, until fn returns false
+func (md *MappedData) Range(fn func(n int, b []byte) bool) error {
+	if md.mmap == nil {
+		return ErrUnmapped
+	}
+	for _, n := range md.bitmap().all() {
+		pos := getOffset(n)
+		if !fn(n, append([]byte(nil), strip(md.mmap[pos:pos+SYS_PAGE])...)) {
+			break
 		}
-		m[v[0].(string)] = page
 	}
-	return m
+	return nil
 }
 
-// closes the mapped file
-func (md *MappedData) CloseMappedData() {
-	md.mmap.Sync()
-	md.mmap.Munmap()
-	md.file.Close()
+// returns a copy of the file header
+func (md *MappedData) Header() []byte {
+	if md.mmap == nil {
+		return nil
+	}
+	return append([]byte(nil), md.mmap[MAXPAGES/8:DATAOFFSET]...)
 }
 
-// check to see if we should grow
-func (md *MappedData) checkGrow() {
-	if md.used+1 < (md.size-DATAOFFSET)/SYS_PAGE {
-		return // no need to grow
+// overwrites the file header with b
+func (md *MappedData) SetHeader(b []byte) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	if md.mmap == nil {
+		return ErrUnmapped
+	}
+	copy(md.mmap[MAXPAGES/8:DATAOFFSET], nilPage[:HEADERSIZE])
+	copy(md.mmap[MAXPAGES/8:DATAOFFSET], b)
+	if md.dirty != nil {
+		md.dirty[(DATAOFFSET-1)/SYS_PAGE] = struct{}{}
 	}
-	// unmap, grow underlying file and remap
-	//md.mmap.Munmap()
-	//md.size = resize(md.file.Fd(), md.size+(1<<24)) // grow size 16MB
-	//md.mmap = Mmap(md.file, 0, md.size)
+	return nil
+}
 
-	md.mmap = md.mmap.Mremap(md.size + (1 << 24))
-	md.size = md.size + (1 << 24)
+// closes the mapped file
+//
+// Deprecated: use Close.
+func (md *MappedData) CloseMappedData() error {
+	return md.Close()
 }
 
-func (md *MappedData) bitMapHas(k int) bool {
-	return (md.mmap[k/8] & (1 << (uint(k % 8)))) != 0
+// closes the mapped file
+func (md *MappedData) Close() error {
+	if md.mmap == nil {
+		return md.file.Close() // lost when a resize failed
+	}
+	if md.readOnly {
+		if err := md.mmap.Munmap(); err != nil {
+			return fmt.Errorf("%s: %w", md.path, err)
+		}
+		return md.file.Close()
+	}
+	if err := md.mmap.Sync(); err != nil {
+		return fmt.Errorf("%s: %w", md.path, err)
+	}
+	if err := md.mmap.Munmap(); err != nil {
+		return fmt.Errorf("%s: %w", md.path, err)
+	}
+	return md.file.Close()
 }
 
-func (md *MappedData) bitMapAdd() int {
-	if k := md.bitMapNext(); k != -1 {
-		md.bitMapSet(k) // add
-		return k
+// Compact relocates up to n live pages from the tail of the file into
+// the lowest free pages, calling moved before it relocates each one so
+// the caller can update any references; if moved fails, the page is
+// left where it is and the error returned. Free space left at the tail
+// is then released by truncating the file. It reports true once there
+// are no more holes to fill.
+func (md *MappedData) Compact(n int, moved func(from, to int) error) (bool, error) {
+	if md.readOnly {
+		return false, ErrReadOnly
+	}
+	if md.mmap == nil {
+		return false, ErrUnmapped
+	}
+	lo, hi := md.bitmap().next(), md.bitmap().last()
+	for ; n > 0 && lo != -1 && lo < hi; n-- {
+		if err := moved(hi, lo); err != nil {
+			return false, err
+		}
+		src, dst := getOffset(hi), getOffset(lo)
+		copy(md.mmap[dst:dst+SYS_PAGE], md.mmap[src:src+SYS_PAGE])
+		copy(md.mmap[src:src+SYS_PAGE], nilPage)
+		md.bitmap().set(lo)
+		md.bitmap().del(hi)
+		md.touch(lo)
+		md.touch(hi)
+		lo, hi = md.bitmap().next(), md.bitmap().last()
+	}
+	if err := md.shrink(hi); err != nil {
+		return false, err
 	}
-	return -1
+	return lo == -1 || lo > hi, nil
 }
 
-func (md *MappedData) bitMapSet(k int) {
-	// flip the n-th bit on; add/set
-	md.mmap[k/8] |= (1 << uint(k%8))
+// release unused space at the tail of the file, keeping
+// the size a multiple of the growth step (ie. 16 MB)
+func (md *MappedData) shrink(last int) error {
+	size := 1 << 24
+	if last != -1 {
+		size = (getOffset(last+1) + (1<<24 - 1)) &^ (1<<24 - 1)
+	}
+	if size >= md.size {
+		return nil // nothing to release
+	}
+	if err := md.remap(size); err != nil {
+		return err
+	}
+	return md.readvise()
 }
 
-func (md *MappedData) bitMapDel(k int) {
-	// flip the k-th bit off; delete
-	md.mmap[k/8] &= ^(1 << uint(k%8))
+// Sync synchronously writes every page modified since the
+// last sync to disk, followed by the file's data.
+func (md *MappedData) Sync() error {
+	if md.mmap == nil {
+		return ErrUnmapped
+	}
+	// a flush still running may hold pages this sync has to cover
+	md.flushing.Wait()
+	md.reclaim()
+	if md.dirty == nil {
+		// nothing is tracked, so sync the lot
+		if err := md.mmap.Sync(); err != nil {
+			return fmt.Errorf("%s: %w", md.path, err)
+		}
+		return fdatasync(md.file)
+	}
+	if len(md.dirty) == 0 {
+		return nil
+	}
+	pages := make([]int, 0, len(md.dirty))
+	for p := range md.dirty {
+		if p*SYS_PAGE < md.size {
+			pages = append(pages, p) // skip anything truncated away
+		}
+	}
+	sort.Ints(pages)
+	// sync each run of consecutive pages with a single call
+	for i, j := 0, 0; i < len(pages); i = j {
+		for j = i + 1; j < len(pages) && pages[j] == pages[j-1]+1; j++ {
+		}
+		if err := md.mmap.SyncRange(pages[i]*SYS_PAGE, (j-i)*SYS_PAGE); err != nil {
+			return fmt.Errorf("%s: %w", md.path, err)
+		}
+	}
+	if err := fdatasync(md.file); err != nil {
+		return err
+	}
+	md.dirty = make(map[int]struct{})
+	return nil
 }
 
-func (md *MappedData) bits(n byte) int {
-	return int(tbl[n>>4] + tbl[n&0x0f])
+// Flush starts writing back every page modified since the last sync and
+// returns a func that waits for the file's data to reach the disk. Only
+// Flush has to be kept apart from writes, so a store need not be locked
+// for the slow part of the sync. Sync waits for it to finish, and the
+// pages are dirty again if it fails.
+func (md *MappedData) Flush() func() error {
+	if md.mmap == nil {
+		return func() error { return ErrUnmapped }
+	}
+	md.reclaim()
+	if md.dirty != nil && len(md.dirty) == 0 {
+		return func() error { return nil }
+	}
+	pages := md.dirty
+	if pages != nil {
+		md.dirty = make(map[int]struct{})
+	}
+	giveBack := func() {
+		md.flushmu.Lock()
+		defer md.flushmu.Unlock()
+		for p := range pages {
+			md.unflushed = append(md.unflushed, p)
+		}
+	}
+	if err := md.mmap.Sync(); err != nil {
+		giveBack()
+		err = fmt.Errorf("%s: %w", md.path, err)
+		return func() error { return err }
+	}
+	// the file stays open until the store that owns it is closed,
+	// which waits for a running flush, and fdatasync covers pages
+	// written through the mapping however it has been remapped since
+	f := md.file
+	md.flushing.Add(1)
+	return func() error {
+		defer md.flushing.Done()
+		err := fdatasync(f)
+		if err != nil {
+			giveBack()
+		}
+		return err
+	}
 }
 
-func (md *MappedData) bitMapNext() int {
-	for i := 0; i < (524272 / 8); i++ {
-		if md.bits(md.mmap[i]) < 8 {
-			for j := 0; j < 8; j++ {
-				cur := (i * 8) + j
-				if !md.bitMapHas(cur) {
-					return cur
-				}
-			}
+// mark the pages failed flushes gave back as dirty again
+func (md *MappedData) reclaim() {
+	md.flushmu.Lock()
+	defer md.flushmu.Unlock()
+	if md.dirty != nil {
+		for _, p := range md.unflushed {
+			md.dirty[p] = struct{}{}
 		}
 	}
-	return -1
+	md.unflushed = nil
 }
 
-func (md *MappedData) bitMapUsed() {
-	for i := 0; i < (524272 / 8); i++ {
-		md.used += md.bits(md.mmap[i])
+// mark the system pages holding the bitmap
+// entry and the data for page n as dirty
+func (md *MappedData) touch(n int) {
+	if md.dirty == nil {
+		return // not tracked
 	}
+	md.dirty[(n/8)/SYS_PAGE] = struct{}{}
+	md.dirty[getOffset(n)/SYS_PAGE] = struct{}{}
 }
 
-func (md *MappedData) bitMapAll() []int {
-	var all []int
-	for i := 0; i < (524272 / 8); i++ {
-		if md.bits(md.mmap[i]) <= 8 {
-			for j := 0; j < 8; j++ {
-				cur := (i * 8) + j
-				if md.bitMapHas(cur) {
-					all = append(all, cur)
-				}
-			}
-		}
+// check to see if we should grow, to make room for page n
+func (md *MappedData) checkGrow(n int) error {
+	size := md.size
+	for md.used+1 >= (size-DATAOFFSET)/SYS_PAGE || getOffset(n)+SYS_PAGE > size {
+		size += 1 << 24 // grow size 16MB
+	}
+	if size == md.size {
+		return nil // no need to grow
+	}
+	// grow underlying file, unmap and remap
+	if err := md.remap(size); err != nil {
+		return err
+	}
+	return md.readvise()
+}
+
+// resize the file and map it again, keeping whatever mapping Mremap
+// manages to make, so that a failed resize leaves the engine usable
+// where it can; if nothing could be mapped every method fails with
+// ErrUnmapped from then on
+func (md *MappedData) remap(size int) error {
+	mmap, err := md.mmap.Mremap(md.file, size)
+	md.mmap = mmap
+	md.size = len(mmap)
+	return err
+}
+
+// Advise hints at how the mapped file is going to be accessed; the
+// hint sticks across remaps. See Data.Advise for the accepted values.
+func (md *MappedData) Advise(advice int) error {
+	atomic.StoreInt32(&md.advice, int32(advice))
+	if md.mmap == nil {
+		return ErrUnmapped
+	}
+	if err := md.mmap.Advise(advice); err != nil {
+		return fmt.Errorf("%s: %w", md.path, err)
+	}
+	return nil
+}
+
+// Residency reports how much of the mapped file is held in memory.
+func (md *MappedData) Residency() (Residency, error) {
+	if md.mmap == nil {
+		return Residency{}, ErrUnmapped
+	}
+	r, err := md.mmap.Residency()
+	if err != nil {
+		return r, fmt.Errorf("%s: %w", md.path, err)
 	}
-	return all
+	return r, nil
+}
+
+// apply the last access hint to a fresh mapping
+func (md *MappedData) readvise() error {
+	if advice := int(atomic.LoadInt32(&md.advice)); advice != syscall.MADV_NORMAL {
+		return md.Advise(advice)
+	}
+	return nil
+}
+
+// the page bitmap stored at the front of the mapping
+func (md *MappedData) bitmap() bitmap {
+	return bitmap(md.mmap[:DATAOFFSET])
 }
 
 func getOffset(pos int) int {
 	return (pos * SYS_PAGE) + DATAOFFSET
 }
 
-// strip null bytes out of page
+// strip the null bytes padding out the end of a page
 func strip(b []byte) []byte {
-	for i, j := 0, len(b)-1; i <= j; i, j = i+1, j-1 {
-		if b[i] == 0x00 {
-			return b[:i]
-		}
-		if b[j] != 0x00 {
-			return b[:j+1]
-		}
+	j := len(b)
+	for j > 0 && b[j-1] == 0x00 {
+		j--
 	}
-	return b
+	return b[:j]
 }
@@ -57,7 +57,65 @@ type DBStore interface {
 	Del(k string)
 }
 
+// Engine is a page oriented storage backend. Pages are SYS_PAGE bytes
+// and addressed by number; a Store keeps one record in each page and
+// indexes its keys by page number. MappedData, FileData and MemData
+// all implement it.
 type Engine interface {
+
+	// allocates a free page, writes b to it and returns its number
+	Add(b []byte) (int, error)
+
+	// writes b to page n, allocating the page if needed
+	Set(n int, b []byte) error
+
+	// returns a copy of page n, or nil if it is not allocated
+	Get(n int) ([]byte, error)
+
+	// frees page n if it is allocated
+	Del(n int) error
+
+	// calls fn for every allocated page, in page order, until fn returns false
+	Range(fn func(n int, b []byte) bool) error
+
+	// flushes every write made so far to stable storage
+	Sync() error
+
+	// releases any resources held by the engine
+	Close() error
+}
+
+// Compacter is implemented by engines that can relocate pages in order
+// to reclaim the space left behind by freed ones. moved is called with
+// the old and new number of every page just before it is relocated;
+// should it fail, the page stays where it is and Compact returns the
+// error.
+type Compacter interface {
+	Compact(n int, moved func(from, to int) error) (bool, error)
+}
+
+// Flusher is implemented by engines that can sync in two steps, so that
+// writes only need to be held up for the first. Flush must not run
+// alongside writes; the func it returns completes the sync, and can run
+// without the store lock held. A Sync made meanwhile waits for it.
+type Flusher interface {
+	Flush() func() error
+}
+
+// Headerer is implemented by engines that keep a small header of
+// HEADERSIZE bytes at the front of their file, which a Store uses to
+// record how its records are encoded.
+type Headerer interface {
+	Header() []byte
+	SetHeader(b []byte) error
+}
+
+// Adviser is implemented by engines backed by a memory mapping. It lets
+// a Store hint at how pages are about to be accessed (see Data.Advise)
+// and report how much of the engine is held in memory.
+type Adviser interface {
+	Advise(advice int) error
+	Residency() (Residency, error)
 }
 
 type Index interface {
@@ -0,0 +1,204 @@
+package idx
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FileData is an Engine that reads and writes pages with pread and
+// pwrite instead of going through a memory mapping. It uses the same
+// file layout as MappedData, so either engine can open the other's
+// data files.
+type FileData struct {
+	path     string
+	file     *os.File
+	size     int
+	bits     bitmap // in memory copy of the bitmap at the front of the file
+	readOnly bool
+}
+
+// open a data file, or create if needed and align the
+// size to the minimum data file size (ie. 16 MB)
+func OpenFileData(path string) (*FileData, error) {
+	return OpenFileDataWith(path, nil)
+}
+
+// open a data file using the supplied options; see OpenMappedDataWith
+func OpenFileDataWith(path string, opts *Options) (*FileData, error) {
+	o := opts.withDefaults()
+	// pwrite does not mix with O_APPEND, so don't use OpenFile here
+	flag := syscall.O_RDWR | syscall.O_CREAT
+	if o.ReadOnly {
+		flag = syscall.O_RDONLY
+	}
+	file, _, size, err := openFile(path+".dat", flag)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(file, !o.ReadOnly, o.LockTimeout); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if size == 0 {
+		if o.ReadOnly {
+			file.Close()
+			return nil, fmt.Errorf("%s: empty data file", file.Name())
+		}
+		size, err = resize(file, 1<<24) // start size 16MB
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	fd := &FileData{
+		path:     file.Name(),
+		file:     file,
+		size:     size,
+		bits:     make(bitmap, DATAOFFSET),
+		readOnly: o.ReadOnly,
+	}
+	if _, err := file.ReadAt(fd.bits, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: reading bitmap: %w", fd.path, err)
+	}
+	return fd, nil
+}
+
+// allocates the lowest free page and writes b to it
+func (fd *FileData) Add(b []byte) (int, error) {
+	if fd.readOnly {
+		return -1, ErrReadOnly
+	}
+	n := fd.bits.next()
+	if n == -1 {
+		return -1, ErrStoreFull
+	}
+	// write the page before marking it used, so a crash
+	// in between never exposes a half written page
+	if err := fd.writePage(n, b); err != nil {
+		return -1, err
+	}
+	fd.bits.set(n)
+	if err := fd.writeBits(n); err != nil {
+		return -1, err
+	}
+	return n, nil
+}
+
+// updates existing or inserts new page n
+func (fd *FileData) Set(n int, b []byte) error {
+	if fd.readOnly {
+		return ErrReadOnly
+	}
+	if n < 0 || n >= MAXPAGES {
+		return ErrStoreFull
+	}
+	if err := fd.writePage(n, b); err != nil {
+		return err
+	}
+	if !fd.bits.has(n) {
+		fd.bits.set(n)
+		return fd.writeBits(n)
+	}
+	return nil
+}
+
+// returns a copy of page n
+func (fd *FileData) Get(n int) ([]byte, error) {
+	if !fd.bits.has(n) {
+		return nil, nil
+	}
+	b := make([]byte, SYS_PAGE)
+	if _, err := fd.file.ReadAt(b, int64(getOffset(n))); err != nil {
+		return nil, fmt.Errorf("%s: reading page %d: %w", fd.path, n, err)
+	}
+	return strip(b), nil
+}
+
+// removes page n
+func (fd *FileData) Del(n int) error {
+	if fd.readOnly {
+		return ErrReadOnly
+	}
+	if !fd.bits.has(n) {
+		return nil
+	}
+	fd.bits.del(n)
+	if err := fd.writeBits(n); err != nil {
+		return err
+	}
+	return fd.writePage(n, nil)
+}
+
+// calls fn for every page in use, in page order, until fn returns false
+func (fd *FileData) Range(fn func(n int, b []byte) bool) error {
+	for _, n := range fd.bits.all() {
+		b, err := fd.Get(n)
+		if err != nil {
+			return err
+		}
+		if !fn(n, b) {
+			break
+		}
+	}
+	return nil
+}
+
+// flushes written pages to disk
+func (fd *FileData) Sync() error {
+	if fd.readOnly {
+		return nil
+	}
+	return fdatasync(fd.file)
+}
+
+// closes the data file
+func (fd *FileData) Close() error {
+	return fd.file.Close()
+}
+
+// write b to page n, zero padded to the page size,
+// growing the file (16 MB at a time) when needed
+func (fd *FileData) writePage(n int, b []byte) error {
+	off := getOffset(n)
+	for off+SYS_PAGE > fd.size {
+		size, err := resize(fd.file, fd.size+(1<<24))
+		if err != nil {
+			return err
+		}
+		fd.size = size
+	}
+	p := make([]byte, SYS_PAGE)
+	copy(p, b)
+	if _, err := fd.file.WriteAt(p, int64(off)); err != nil {
+		return fmt.Errorf("%s: writing page %d: %w", fd.path, n, err)
+	}
+	return nil
+}
+
+// returns a copy of the file header
+func (fd *FileData) Header() []byte {
+	return append([]byte(nil), fd.bits[MAXPAGES/8:]...)
+}
+
+// overwrites the file header with b
+func (fd *FileData) SetHeader(b []byte) error {
+	if fd.readOnly {
+		return ErrReadOnly
+	}
+	copy(fd.bits[MAXPAGES/8:], nilPage[:HEADERSIZE])
+	copy(fd.bits[MAXPAGES/8:], b)
+	if _, err := fd.file.WriteAt(fd.bits[MAXPAGES/8:], MAXPAGES/8); err != nil {
+		return fmt.Errorf("%s: writing header: %w", fd.path, err)
+	}
+	return nil
+}
+
+// write the bitmap byte holding the bit for page n
+func (fd *FileData) writeBits(n int) error {
+	if _, err := fd.file.WriteAt(fd.bits[n/8:n/8+1], int64(n/8)); err != nil {
+		return fmt.Errorf("%s: writing bitmap: %w", fd.path, err)
+	}
+	return nil
+}
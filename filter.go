@@ -0,0 +1,205 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// Filter decides whether a document matches. Documents are handed to
+// it decoded into an interface{}, the same way Extractors see them.
+// Filters made of Conds combined with And and Or can be answered using
+// secondary indexes; any other Filter makes a query scan the store.
+type Filter interface {
+	Match(doc interface{}) bool
+}
+
+// Op is a comparison made by a Cond.
+type Op int
+
+const (
+	OpEq     Op = iota // equal to
+	OpNe               // not equal to
+	OpLt               // less than
+	OpLte              // less than or equal to
+	OpGt               // greater than
+	OpGte              // greater than or equal to
+	OpIn               // equal to one of a list of values
+	OpPrefix           // a string starting with
+)
+
+var opNames = [...]string{"=", "!=", "<", "<=", ">", ">=", "IN", "PREFIX"}
+
+func (op Op) String() string {
+	if op < 0 || int(op) >= len(opNames) {
+		return "?"
+	}
+	return opNames[op]
+}
+
+// KeyField is a pseudo field holding the record's key, which can be
+// compared like any other; conditions on it are answered by scanning
+// just the matching range of keys.
+const KeyField = "_key"
+
+// Cond is a Filter comparing the field at a dot separated path into a
+// document, written the same way as a Path, with a value. Numbers of
+// any type compare by value, strings and byte slices compare bytewise,
+// and values of different kinds never match. When the field holds a
+// list the document matches if any element of it does, and a missing
+// field only matches OpNe.
+type Cond struct {
+	Field string
+	Op    Op
+	Value interface{} // a []interface{} for OpIn
+}
+
+func (c Cond) Match(doc interface{}) bool {
+	v, ok := lookup(doc, Path(c.Field).parts())
+	if !ok {
+		return c.Op == OpNe
+	}
+	if list, ok := v.([]interface{}); ok {
+		if c.Op == OpNe {
+			// none of the elements are equal
+			return !(Cond{c.Field, OpEq, c.Value}).matchAny(list)
+		}
+		return c.matchAny(list)
+	}
+	return c.match(v)
+}
+
+func (c Cond) matchAny(list []interface{}) bool {
+	for _, v := range list {
+		if c.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Cond) match(v interface{}) bool {
+	switch c.Op {
+	case OpIn:
+		vals, _ := c.Value.([]interface{})
+		for _, want := range vals {
+			if n, ok := compare(v, want); ok && n == 0 {
+				return true
+			}
+		}
+		return false
+	case OpPrefix:
+		s, ok := text(v)
+		p, pok := text(c.Value)
+		return ok && pok && bytes.HasPrefix(s, p)
+	}
+	n, ok := compare(v, c.Value)
+	switch c.Op {
+	case OpEq:
+		return ok && n == 0
+	case OpNe:
+		return !ok || n != 0
+	case OpLt:
+		return ok && n < 0
+	case OpLte:
+		return ok && n <= 0
+	case OpGt:
+		return ok && n > 0
+	case OpGte:
+		return ok && n >= 0
+	}
+	return false
+}
+
+// And is a Filter matching documents that match all of its filters.
+type And []Filter
+
+func (a And) Match(doc interface{}) bool {
+	for _, f := range a {
+		if !f.Match(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// Or is a Filter matching documents that match any of its filters.
+type Or []Filter
+
+func (o Or) Match(doc interface{}) bool {
+	for _, f := range o {
+		if f.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare two values, false if they are not of comparable kinds
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	if x, ok := text(a); ok {
+		y, ok := text(b)
+		return bytes.Compare(x, y), ok
+	}
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		switch {
+		case !ok:
+			return 0, false
+		case x == y:
+			return 0, true
+		case y:
+			return -1, true // false sorts before true
+		}
+		return 1, true
+	}
+	if a == nil || b == nil {
+		return 0, a == nil && b == nil
+	}
+	return 0, false
+}
+
+// a numeric value as a float64
+func number(v interface{}) (float64, bool) {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// a string or byte slice value as bytes
+func text(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.String {
+		return []byte(rv.String()), true
+	}
+	return nil, false
+}
@@ -0,0 +1,472 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Extractor returns the values a document is indexed under. It is
+// handed the document's value decoded into an interface{}, so JSON
+// objects arrive as a map[string]interface{}. Values other than bools,
+// numbers, strings and byte slices are not indexed, and numbers are
+// indexed as float64, so 1 and 1.0 are the same value.
+type Extractor interface {
+	Extract(doc interface{}) []interface{}
+}
+
+// ExtractFunc is an Extractor written as a Go func.
+type ExtractFunc func(doc interface{}) []interface{}
+
+func (fn ExtractFunc) Extract(doc interface{}) []interface{} {
+	return fn(doc)
+}
+
+// Path is an Extractor for the field at a dot separated path into the
+// document, such as "email" or "address.city"; list elements are
+// addressed by number, as in "items.0.sku", and a leading "$." is
+// ignored. When the field holds a list, the document is indexed under
+// every element of it. Queries on a field use indexes on its Path.
+type Path string
+
+func (p Path) Extract(doc interface{}) []interface{} {
+	v, ok := lookup(doc, p.parts())
+	if !ok {
+		return nil
+	}
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+// String returns the path without any leading "$.".
+func (p Path) String() string {
+	return strings.TrimPrefix(string(p), "$.")
+}
+
+func (p Path) parts() []string {
+	return strings.Split(p.String(), ".")
+}
+
+// returns the value at a path into a generically decoded document
+func lookup(doc interface{}, path []string) (interface{}, bool) {
+	for _, p := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[p]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case map[interface{}]interface{}:
+			v, ok := d[p]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(d) {
+				return nil, false
+			}
+			doc = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// a secondary index; each entry's key is an encoded value followed by
+// the primary key of a record holding it, and its value is that key
+type fieldIndex struct {
+	name    string
+	extract Extractor
+	unique  bool // no two records may share a value
+	tree    *Tree
+}
+
+// an index entry along with the value it was made from
+type entry struct {
+	key   []byte
+	value interface{}
+}
+
+// the entries a document adds to the index
+func (ix *fieldIndex) entries(k []byte, doc interface{}) []entry {
+	var es []entry
+	for _, v := range ix.extract.Extract(doc) {
+		if b, ok := indexValue(v); ok {
+			es = append(es, entry{append(b, k...), v})
+		}
+	}
+	return es
+}
+
+// returns an *ErrUniqueViolation if the index is unique and already
+// holds the entry's value for a key other than k, ignoring keys that
+// are gone, having expired
+func (ix *fieldIndex) check(k []byte, e entry, gone func(k []byte) bool) error {
+	if !ix.unique {
+		return nil
+	}
+	var err error
+	prefix := e.key[:len(e.key)-len(k)]
+	ix.tree.Ascend(prefix, func(r *Record) bool {
+		if !bytes.HasPrefix(r.Key, prefix) {
+			return false
+		}
+		if !bytes.Equal(r.Val, k) && !gone(r.Val) {
+			err = &ErrUniqueViolation{Index: ix.name, Value: e.value}
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// ErrUniqueViolation is returned by writes that would give two records
+// the same value in a unique index, and when creating a unique index
+// over records that already do. Nothing is written when it is returned.
+type ErrUniqueViolation struct {
+	Index string
+	Value interface{}
+}
+
+func (e *ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("unique index %q already holds %v", e.Index, e.Value)
+}
+
+// CreateIndex adds a secondary index to the store, built from the
+// records it already holds and kept up to date by every write from then
+// on. Indexes live in memory; to have them rebuilt whenever the store
+// is opened, list them in Options.Indexes instead. Stores using
+// GobCodec or RawCodec can't be indexed and fail with ErrNotDocument.
+func (st *Store) CreateIndex(name string, fn Extractor) error {
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.createIndex(name, fn, false)
+}
+
+// CreateUniqueIndex adds a secondary index that no two records may
+// share a value in. It fails with an *ErrUniqueViolation if records
+// in the store already do, and from then on so does any write that
+// would. Unique indexes are listed in Options.UniqueIndexes to have
+// them rebuilt whenever the store is opened.
+func (st *Store) CreateUniqueIndex(name string, fn Extractor) error {
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.createIndex(name, fn, true)
+}
+
+// must hold the lock
+func (st *Store) createIndex(name string, fn Extractor, unique bool) error {
+	if _, ok := st.indexes[name]; ok {
+		return fmt.Errorf("%w: index %q", ErrExists, name)
+	}
+	if !st.documents() {
+		return fmt.Errorf("%w: index %q", ErrNotDocument, name)
+	}
+	ix := &fieldIndex{name: name, extract: fn, unique: unique}
+	if err := st.build(ix); err != nil {
+		return err
+	}
+	st.indexes[name] = ix
+	return nil
+}
+
+// fill an index from the records in the store; must hold the lock
+func (st *Store) build(ix *fieldIndex) error {
+	defer st.scanning()()
+	tree, build := NewTree(), *ix
+	build.tree = tree
+	var err error
+	if rerr := st.engine.Range(func(n int, b []byte) bool {
+		var k []byte
+		var doc interface{}
+		if k, err = st.key(b); err == nil {
+			err = st.value(b, &doc)
+		}
+		if err != nil {
+			err = fmt.Errorf("index %q: page %d: %w", ix.name, n, err)
+			return false
+		}
+		for _, e := range ix.entries(k, doc) {
+			if err = build.check(k, e, st.expired); err != nil {
+				return false
+			}
+			tree.Set(e.key, k)
+		}
+		return true
+	}); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return err
+	}
+	ix.tree = tree
+	return nil
+}
+
+// DropIndex removes a secondary index.
+func (st *Store) DropIndex(name string) error {
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	if _, ok := st.indexes[name]; !ok {
+		return fmt.Errorf("%w: index %q", ErrNoIndex, name)
+	}
+	delete(st.indexes, name)
+	return nil
+}
+
+// GetBy decodes the first record, in key order, that the named index
+// holds under value into ptr, just as Get would.
+func (st *Store) GetBy(index string, value, ptr interface{}) error {
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return ErrClosed
+	}
+	keys, err := st.keysBy(index, value, 1)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+	return st.get(keys[0], ptr)
+}
+
+// KeysBy returns the keys of every record the named
+// index holds under value, in key order.
+func (st *Store) KeysBy(index string, value interface{}) ([][]byte, error) {
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return nil, ErrClosed
+	}
+	return st.keysBy(index, value, -1)
+}
+
+// must hold the lock
+func (st *Store) keysBy(index string, value interface{}, limit int) ([][]byte, error) {
+	ix, ok := st.indexes[index]
+	if !ok {
+		return nil, fmt.Errorf("%w: index %q", ErrNoIndex, index)
+	}
+	prefix, ok := indexValue(value)
+	if !ok {
+		return nil, nil // can't be indexed, so can't be found
+	}
+	var keys [][]byte
+	ix.tree.Ascend(prefix, func(r *Record) bool {
+		if !bytes.HasPrefix(r.Key, prefix) || len(keys) == limit {
+			return false
+		}
+		if !st.expired(r.Val) {
+			keys = append(keys, append([]byte(nil), r.Val...))
+		}
+		return true
+	})
+	return keys, nil
+}
+
+// the changes a write makes to the secondary indexes
+type reindex struct {
+	from, to map[*fieldIndex][]entry
+}
+
+// work out how the secondary indexes change when the record for k
+// goes from old to rec, either of which may be nil; must hold the lock
+func (st *Store) reindex(k, old, rec []byte) (*reindex, error) {
+	var err error
+	ri := &reindex{}
+	if ri.from, err = st.entries(k, old); err != nil {
+		return nil, err
+	}
+	if ri.to, err = st.entries(k, rec); err != nil {
+		return nil, err
+	}
+	return ri, nil
+}
+
+// the entries a record adds to each secondary index
+func (st *Store) entries(k, rec []byte) (map[*fieldIndex][]entry, error) {
+	if rec == nil {
+		return nil, nil
+	}
+	var doc interface{}
+	if err := st.value(rec, &doc); err != nil {
+		return nil, err
+	}
+	es := make(map[*fieldIndex][]entry, len(st.indexes))
+	for _, ix := range st.indexes {
+		es[ix] = ix.entries(k, doc)
+	}
+	return es, nil
+}
+
+// make sure the change doesn't break any unique constraint
+func (ri *reindex) check(k []byte, gone func(k []byte) bool) error {
+	for ix, es := range ri.to {
+		for _, e := range es {
+			if err := ix.check(k, e, gone); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// make sure none of ops breaks a unique constraint when they are
+// applied in order, without touching the indexes, so a batch can be
+// turned down before it is journaled; must hold the lock
+func (st *Store) precheck(ops []*op) error {
+	// for each unique index, the key holding every value the ops
+	// so far have moved, or "" if they left it free
+	held := make(map[*fieldIndex]map[string]string)
+	for _, ix := range st.indexes {
+		if ix.unique {
+			held[ix] = make(map[string]string)
+		}
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	recs := make(map[string][]byte) // records as the ops so far leave them
+	for _, o := range ops {
+		k := string(o.key)
+		old, ok := recs[k]
+		if !ok {
+			var err error
+			if old, err = st.current(o.key); err != nil {
+				return err
+			}
+		}
+		ri, err := st.reindex(o.key, old, o.rec)
+		if err != nil {
+			return err
+		}
+		for ix, es := range ri.from {
+			for _, e := range es {
+				if vals := held[ix]; vals != nil {
+					v := string(e.key[:len(e.key)-len(k)])
+					if h, ok := vals[v]; !ok || h == k {
+						vals[v] = ""
+					}
+				}
+			}
+		}
+		for ix, es := range ri.to {
+			vals := held[ix]
+			if vals == nil {
+				continue
+			}
+			for _, e := range es {
+				h, ok := vals[string(e.key[:len(e.key)-len(k)])]
+				if !ok {
+					err = ix.check(o.key, e, st.expired)
+				} else if h != "" && h != k {
+					err = &ErrUniqueViolation{Index: ix.name, Value: e.value}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			for _, e := range es {
+				vals[string(e.key[:len(e.key)-len(k)])] = k
+			}
+		}
+		recs[k] = o.rec
+	}
+	return nil
+}
+
+func (ri *reindex) apply(k []byte) {
+	k = append([]byte(nil), k...)
+	for ix, es := range ri.from {
+		for _, e := range es {
+			ix.tree.Del(e.key)
+		}
+	}
+	for ix, es := range ri.to {
+		for _, e := range es {
+			ix.tree.Set(e.key, k)
+		}
+	}
+}
+
+// index values are encoded so they sort in the same order as the
+// values themselves, with a leading byte for their type, and so none
+// is a prefix of another; that way an entry's value and key can
+// simply be concatenated
+const (
+	ixBool byte = iota + 1
+	ixNumber
+	ixString
+	ixBytes
+)
+
+// encode a value for use in an index, false if it can't be indexed
+func indexValue(v interface{}) ([]byte, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return []byte{ixBool, 1}, true
+		}
+		return []byte{ixBool, 0}, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return indexFloat(float64(rv.Int())), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return indexFloat(float64(rv.Uint())), true
+	case reflect.Float32, reflect.Float64:
+		return indexFloat(rv.Float()), true
+	case reflect.String:
+		return indexBytes(ixString, []byte(rv.String())), true
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return indexBytes(ixBytes, rv.Bytes()), true
+		}
+	}
+	return nil, false
+}
+
+func indexFloat(f float64) []byte {
+	if f == 0 {
+		f = 0 // fold -0 into 0
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63 // positive numbers sort after negative ones
+	} else {
+		bits = ^bits // and larger negative numbers before smaller ones
+	}
+	return binary.BigEndian.AppendUint64([]byte{ixNumber}, bits)
+}
+
+// escape any null bytes as 0x00 0xff and end with 0x00 0x01
+func indexBytes(tag byte, b []byte) []byte {
+	out := make([]byte, 1, len(b)+3)
+	out[0] = tag
+	for _, c := range b {
+		if out = append(out, c); c == 0x00 {
+			out = append(out, 0xff)
+		}
+	}
+	return append(out, 0x00, 0x01)
+}
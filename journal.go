@@ -0,0 +1,163 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+// The journal makes multi key commits atomic across crashes. A commit
+// is written to it and synced before any of its changes are applied,
+// then cleared once the engine has been synced. If the store is opened
+// with a complete commit still in the journal, the crash happened part
+// way through applying it, so it is applied again (writes are
+// idempotent). An incomplete commit was never applied and is dropped.
+//
+//	magic[8] count[4] { keylen[4] key reclen[4] rec }... crc32[4]
+//
+// a reclen of delLen marks a delete. Keys are not encrypted along with
+// records, so the journal of an encrypted store seals everything after
+// the magic, much as records seal their payload:
+//
+//	magic[8] keyid[4] nonce[12] sealed(count[4] {...}...) crc32[4]
+var (
+	journalMagic       = []byte("IDXWAL01")
+	journalSealedMagic = []byte("IDXWAL02")
+)
+
+const delLen = 0xffffffff
+
+type journal struct {
+	file *os.File
+	// encrypt and decrypt commits, if the store is encrypted
+	seal func(hdr, b []byte) ([]byte, []byte, error)
+	open func(ad, ext, b []byte) ([]byte, error)
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: f}, nil
+}
+
+// write a commit to the journal and sync it to disk
+func (j *journal) write(ops []*op) error {
+	var buf bytes.Buffer
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(ops)))
+	buf.Write(n[:])
+	for _, o := range ops {
+		binary.BigEndian.PutUint32(n[:], uint32(len(o.key)))
+		buf.Write(n[:])
+		buf.Write(o.key)
+		if o.rec == nil {
+			binary.BigEndian.PutUint32(n[:], delLen)
+			buf.Write(n[:])
+			continue
+		}
+		binary.BigEndian.PutUint32(n[:], uint32(len(o.rec)))
+		buf.Write(n[:])
+		buf.Write(o.rec)
+	}
+	b := append(append([]byte(nil), journalMagic...), buf.Bytes()...)
+	if j.seal != nil {
+		hdr := append([]byte(nil), journalSealedMagic...)
+		ext, sealed, err := j.seal(hdr, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		b = append(append(hdr, ext...), sealed...)
+	}
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return fdatasync(j.file)
+}
+
+// return the commit held in the journal, if there is a complete one
+func (j *journal) read() ([]*op, error) {
+	fi, err := j.file.Stat()
+	if err != nil || fi.Size() == 0 {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	if _, err := j.file.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	if len(b) < len(journalMagic)+8 {
+		return nil, nil
+	}
+	magic, body := b[:len(journalMagic)], b[:len(b)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+		return nil, nil // torn write; never applied
+	}
+	body = body[len(magic):]
+	switch {
+	case bytes.Equal(magic, journalSealedMagic):
+		if j.open == nil {
+			return nil, ErrNoKey
+		}
+		if len(body) < recCryptExt {
+			return nil, ErrBadRecord
+		}
+		ad := b[:len(magic)+recCryptExt]
+		if body, err = j.open(ad, body[:recCryptExt], body[recCryptExt:]); err != nil {
+			return nil, err
+		}
+		if len(body) < 4 {
+			return nil, ErrBadRecord
+		}
+	case !bytes.Equal(magic, journalMagic):
+		return nil, nil
+	}
+	count := binary.BigEndian.Uint32(body)
+	body = body[4:]
+	next := func() ([]byte, bool) {
+		if len(body) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if n == delLen {
+			return nil, true
+		}
+		if uint32(len(body)) < n {
+			return nil, false
+		}
+		v := body[:n:n]
+		body = body[n:]
+		return v, true
+	}
+	ops := make([]*op, 0, count)
+	for i := uint32(0); i < count; i++ {
+		k, ok := next()
+		if !ok || k == nil {
+			return nil, ErrBadRecord
+		}
+		rec, ok := next()
+		if !ok {
+			return nil, ErrBadRecord
+		}
+		ops = append(ops, &op{key: k, rec: rec})
+	}
+	return ops, nil
+}
+
+// empty the journal once its commit has reached the engine
+func (j *journal) clear() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return fdatasync(j.file)
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,40 @@
+package idx
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// how long to back off between attempts to take a contended lock
+const lockRetry = 10 * time.Millisecond
+
+// take an advisory lock on the file; exclusive for writers and
+// shared for readers. if another process holds a conflicting lock
+// keep retrying until the timeout expires, failing with ErrLocked.
+// the lock is released when the file is closed.
+func flock(f *os.File, exclusive bool, timeout time.Duration) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			return fmt.Errorf("flock %s: %w", f.Name(), err)
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return fmt.Errorf("%s: %w", f.Name(), ErrLocked)
+		}
+		if wait > lockRetry {
+			wait = lockRetry
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,96 @@
+package idx
+
+// MemData is an Engine that keeps its pages in memory. Nothing
+// is ever written to disk, which makes it useful for tests and
+// for short lived stores.
+type MemData struct {
+	bits  bitmap
+	pages map[int][]byte
+}
+
+// returns a new, empty in memory engine
+func NewMemData() *MemData {
+	return &MemData{
+		bits:  make(bitmap, DATAOFFSET),
+		pages: make(map[int][]byte),
+	}
+}
+
+// allocates the lowest free page and writes b to it
+func (m *MemData) Add(b []byte) (int, error) {
+	n := m.bits.add()
+	if n == -1 {
+		return -1, ErrStoreFull
+	}
+	m.pages[n] = page(b)
+	return n, nil
+}
+
+// updates existing or inserts new page n
+func (m *MemData) Set(n int, b []byte) error {
+	if n < 0 || n >= MAXPAGES {
+		return ErrStoreFull
+	}
+	m.bits.set(n)
+	m.pages[n] = page(b)
+	return nil
+}
+
+// returns a copy of page n
+func (m *MemData) Get(n int) ([]byte, error) {
+	if m.bits.has(n) {
+		return append([]byte(nil), m.pages[n]...), nil
+	}
+	return nil, nil
+}
+
+// removes page n
+func (m *MemData) Del(n int) error {
+	if m.bits.has(n) {
+		m.bits.del(n)
+		delete(m.pages, n)
+	}
+	return nil
+}
+
+// calls fn for every page in use, in page order, until fn returns false
+func (m *MemData) Range(fn func(n int, b []byte) bool) error {
+	for _, n := range m.bits.all() {
+		if !fn(n, append([]byte(nil), m.pages[n]...)) {
+			break
+		}
+	}
+	return nil
+}
+
+// returns a copy of the header
+func (m *MemData) Header() []byte {
+	return append([]byte(nil), m.bits[MAXPAGES/8:]...)
+}
+
+// overwrites the header with b
+func (m *MemData) SetHeader(b []byte) error {
+	copy(m.bits[MAXPAGES/8:], nilPage[:HEADERSIZE])
+	copy(m.bits[MAXPAGES/8:], b)
+	return nil
+}
+
+// nothing to flush
+func (m *MemData) Sync() error {
+	return nil
+}
+
+// drops every page
+func (m *MemData) Close() error {
+	m.pages = nil
+	return nil
+}
+
+// copy b, truncated to the page size and stripped of the
+// trailing null bytes it would be padded with on disk
+func page(b []byte) []byte {
+	if len(b) > SYS_PAGE {
+		b = b[:SYS_PAGE]
+	}
+	return append([]byte(nil), strip(b)...)
+}
@@ -1,6 +1,7 @@
 package idx
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"syscall"
@@ -9,74 +10,170 @@ import (
 
 type Data []byte
 
-func Mmap(f *os.File, off, len int) Data {
-	data, err := syscall.Mmap(int(f.Fd()), int64(off), len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+func Mmap(f *os.File, off, len int) (Data, error) {
+	return mmap(f, off, len, syscall.PROT_READ|syscall.PROT_WRITE)
+}
+
+// MmapReadOnly maps the file for reading only; any
+// attempt to write to the returned Data will fault.
+func MmapReadOnly(f *os.File, off, len int) (Data, error) {
+	return mmap(f, off, len, syscall.PROT_READ)
+}
+
+func mmap(f *os.File, off, len, prot int) (Data, error) {
+	data, err := syscall.Mmap(int(f.Fd()), int64(off), len, prot, syscall.MAP_SHARED)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("mmap %s (offset %d, size %d): %w", f.Name(), off, len, err)
 	}
-	return data
+	return data, nil
 }
 
-func (d Data) Mlock() {
+func (d Data) Mlock() error {
 	err := syscall.Mlock(d)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("mlock (size %d): %w", len(d), err)
 	}
+	return nil
 }
 
-func (d Data) Munlock() {
+func (d Data) Munlock() error {
 	err := syscall.Munlock(d)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("munlock (size %d): %w", len(d), err)
 	}
+	return nil
 }
 
-func (d Data) Munmap() {
+func (d Data) Munmap() error {
 	err := syscall.Munmap(d)
-	d = nil
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("munmap (size %d): %w", len(d), err)
 	}
+	return nil
 }
 
-func (d Data) Sync() {
+func (d Data) Sync() error {
+	if len(d) == 0 {
+		return ErrUnmapped
+	}
 	_, _, err := syscall.Syscall(syscall.SYS_MSYNC,
 		uintptr(unsafe.Pointer(&d[0])), uintptr(len(d)),
 		uintptr(syscall.MS_ASYNC))
 	if err != 0 {
-		panic(err)
+		return fmt.Errorf("msync (size %d): %w", len(d), err)
 	}
+	return nil
 }
 
-func (d Data) Mremap(size int) Data {
-	fd := uintptr(unsafe.Pointer(&d[0]))
-	err := syscall.Munmap(d)
-	d = nil
-	if err != nil {
-		panic(err)
+// SyncRange synchronously flushes n bytes of the mapping starting at
+// off, which must be page aligned, blocking until they are written.
+func (d Data) SyncRange(off, n int) error {
+	if off+n > len(d) || off < 0 {
+		return fmt.Errorf("msync (offset %d, size %d): %w", off, n, ErrUnmapped)
 	}
-	err = syscall.Ftruncate(int(fd), int64(align(size)))
-	if err != nil {
-		panic(err)
+	_, _, err := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&d[off])), uintptr(n),
+		uintptr(syscall.MS_SYNC))
+	if err != 0 {
+		return fmt.Errorf("msync (offset %d, size %d): %w", off, n, err)
 	}
-	d, err = syscall.Mmap(int(fd), int64(0), size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		panic(err)
+	return nil
+}
+
+// Advise tells the kernel how the mapping is going to be accessed,
+// using one of syscall.MADV_NORMAL, MADV_RANDOM, MADV_SEQUENTIAL,
+// MADV_WILLNEED or MADV_DONTNEED, so it can tune readahead and decide
+// which pages to keep cached.
+func (d Data) Advise(advice int) error {
+	if err := syscall.Madvise(d, advice); err != nil {
+		return fmt.Errorf("madvise (size %d, advice %d): %w", len(d), advice, err)
+	}
+	return nil
+}
+
+// Residency reports how many system pages of a mapping are
+// currently held in memory, as opposed to only being on disk.
+type Residency struct {
+	Pages    int // system pages in the mapping
+	Resident int // pages held in memory
+}
+
+// Fraction returns the part of the mapping that is held in memory.
+func (r Residency) Fraction() float64 {
+	if r.Pages == 0 {
+		return 0
 	}
-	return d
+	return float64(r.Resident) / float64(r.Pages)
+}
+
+// Residency uses mincore to report how much of the mapping is in memory.
+func (d Data) Residency() (Residency, error) {
+	if len(d) == 0 {
+		return Residency{}, ErrUnmapped
+	}
+	vec := make([]byte, (len(d)+SYS_PAGE-1)/SYS_PAGE)
+	_, _, err := syscall.Syscall(syscall.SYS_MINCORE,
+		uintptr(unsafe.Pointer(&d[0])), uintptr(len(d)),
+		uintptr(unsafe.Pointer(&vec[0])))
+	if err != 0 {
+		return Residency{}, fmt.Errorf("mincore (size %d): %w", len(d), err)
+	}
+	r := Residency{Pages: len(vec)}
+	for _, v := range vec {
+		r.Resident += int(v & 1)
+	}
+	return r, nil
+}
+
+// Mremap resizes the file backing the mapping and maps it again at the
+// new size. The old mapping is released before the new one is made (the
+// syscall package has to know about every mapping it unmaps, which rules
+// out mremap(2)), so any slices still pointing into it are invalid once
+// Mremap returns. If the file cannot be resized the old mapping is kept,
+// and if it can't be mapped again at the new size as much of it as
+// still fits is mapped instead; either way that mapping is returned
+// along with the error, so callers should always keep the returned
+// Data. Should even that fail, the returned Data is nil and the error
+// wraps ErrUnmapped.
+func (d Data) Mremap(f *os.File, size int) (Data, error) {
+	if _, err := resize(f, size); err != nil {
+		return d, err
+	}
+	if err := d.Munmap(); err != nil {
+		return d, fmt.Errorf("mremap %s (size %d): %w", f.Name(), size, err)
+	}
+	data, err := Mmap(f, 0, size)
+	if err == nil {
+		return data, nil
+	}
+	old, oerr := Mmap(f, 0, min(len(d), size))
+	if oerr != nil {
+		return nil, fmt.Errorf("%w: %v; %v", ErrUnmapped, err, oerr)
+	}
+	return old, err
 }
 
 // open file helper
-func OpenFile(path string) (*os.File, string, int) {
-	fd, err := os.OpenFile(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_APPEND, 0644)
+func OpenFile(path string) (*os.File, string, int, error) {
+	return openFile(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_APPEND)
+}
+
+// open file helper; fails if the file does not exist
+func OpenFileReadOnly(path string) (*os.File, string, int, error) {
+	return openFile(path, syscall.O_RDONLY)
+}
+
+func openFile(path string, flag int) (*os.File, string, int, error) {
+	fd, err := os.OpenFile(path, flag, 0644)
 	if err != nil {
-		panic(err)
+		return nil, "", 0, err
 	}
 	fi, err := fd.Stat()
 	if err != nil {
-		panic(err)
+		fd.Close()
+		return nil, "", 0, err
 	}
-	return fd, sanitize(fi.Name()), int(fi.Size())
+	return fd, sanitize(fi.Name()), int(fi.Size()), nil
 }
 
 func sanitize(path string) string {
@@ -98,10 +195,10 @@ func align(size int) int {
 }
 
 // resize underlying file -- helper
-func resize(fd uintptr, size int) int {
-	err := syscall.Ftruncate(int(fd), int64(align(size)))
+func resize(f *os.File, size int) (int, error) {
+	err := syscall.Ftruncate(int(f.Fd()), int64(align(size)))
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("resize %s (size %d): %w", f.Name(), align(size), err)
 	}
-	return size
+	return size, nil
 }
@@ -0,0 +1,162 @@
+package idx
+
+// Records are updated in place, so to give readers a consistent
+// snapshot the store keeps hold of the versions its commits replace
+// for as long as an active snapshot might still need them.
+//
+// Every commit is stamped with the next value of the store's clock.
+// A snapshot taken at time ts sees every commit stamped ts or earlier
+// and nothing after. When a commit replaces or deletes a record while
+// snapshots are active, the old record is kept as a version that was
+// current until the commit's timestamp. A snapshot reading a key then
+// uses the oldest version that was replaced after it was taken, or
+// the record in the store if there is none.
+
+// a record as it was before the commit stamped until replaced it
+type version struct {
+	key   string
+	until uint64
+	rec   []byte // nil if the key did not exist
+}
+
+// take a snapshot of the store as of the last commit; it must
+// be released once the snapshot is no longer being read from
+func (st *Store) begin() (uint64, error) {
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return 0, ErrClosed
+	}
+	st.snapmu.Lock()
+	defer st.snapmu.Unlock()
+	st.snaps[st.clock]++
+	return st.clock, nil
+}
+
+// release a snapshot taken with begin
+func (st *Store) release(ts uint64) {
+	st.snapmu.Lock()
+	defer st.snapmu.Unlock()
+	if st.snaps[ts]--; st.snaps[ts] == 0 {
+		delete(st.snaps, ts)
+	}
+}
+
+// the timestamp of the oldest active snapshot, false if there are none
+func (st *Store) oldest() (uint64, bool) {
+	st.snapmu.Lock()
+	defer st.snapmu.Unlock()
+	var min uint64
+	first := true
+	for ts := range st.snaps {
+		if first || ts < min {
+			min, first = ts, false
+		}
+	}
+	return min, !first
+}
+
+// the records a commit is about to replace, to be kept for any
+// snapshot that is still active once it succeeds; see keep. must
+// hold the lock
+func (st *Store) retain(ops []*op) ([]*version, error) {
+	if _, ok := st.oldest(); !ok {
+		return nil, nil // nobody could see the old records
+	}
+	var vs []*version
+	seen := make(map[string]bool, len(ops))
+	for _, o := range ops {
+		k := string(o.key)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		rec, err := st.current(o.key)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, &version{key: k, until: st.clock + 1, rec: rec})
+	}
+	return vs, nil
+}
+
+// stamp a commit that has been written and keep the records it
+// replaced, as returned by retain; must hold the lock
+func (st *Store) keep(vs []*version) {
+	st.clock++
+	st.gc()
+	for _, v := range vs {
+		st.history[v.key] = append(st.history[v.key], v)
+		st.versions = append(st.versions, v)
+	}
+}
+
+// returns the record for a key as seen by the snapshot taken at ts,
+// or nil if the key did not exist then; must hold the lock
+func (st *Store) read(k []byte, ts uint64) ([]byte, error) {
+	if v := st.replaced(k, ts); v != nil {
+		if v.rec != nil && lapsed(v.rec) {
+			return nil, nil
+		}
+		return v.rec, nil
+	}
+	if st.expired(k) {
+		return nil, nil
+	}
+	return st.current(k)
+}
+
+// reports whether a key existed in the snapshot taken at
+// ts, without reading its record; must hold the lock
+func (st *Store) visible(k []byte, ts uint64) bool {
+	if v := st.replaced(k, ts); v != nil {
+		return v.rec != nil && !lapsed(v.rec)
+	}
+	return st.index.Has(k) && !st.expired(k)
+}
+
+// the oldest version of a key replaced after ts, or nil
+// if the key has not changed since; must hold the lock
+func (st *Store) replaced(k []byte, ts uint64) *version {
+	for _, v := range st.history[string(k)] {
+		if v.until > ts {
+			return v
+		}
+	}
+	return nil
+}
+
+// GC discards old versions of records that no active snapshot can
+// see any more, returning how many were reclaimed. Commits already
+// collect garbage as they go, so calling it is seldom necessary.
+func (st *Store) GC() int {
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return 0
+	}
+	return st.gc()
+}
+
+// must hold the lock
+func (st *Store) gc() int {
+	ts, ok := st.oldest()
+	if !ok {
+		n := len(st.versions)
+		if n > 0 {
+			st.history, st.versions = make(map[string][]*version), nil
+		}
+		return n
+	}
+	// versions are queued in commit order, which is also
+	// the order they appear in within each key's history
+	n := 0
+	for ; n < len(st.versions) && st.versions[n].until <= ts; n++ {
+		v := st.versions[n]
+		if st.history[v.key] = st.history[v.key][1:]; len(st.history[v.key]) == 0 {
+			delete(st.history, v.key)
+		}
+	}
+	st.versions = st.versions[n:]
+	return n
+}
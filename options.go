@@ -0,0 +1,102 @@
+package idx
+
+import "time"
+
+// Durability controls when writes are flushed to stable storage.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing up to the kernel; dirty
+	// pages are only synced explicitly when the store is closed.
+	DurabilityNone Durability = iota
+
+	// DurabilityPeriodic flushes dirty pages from a background
+	// goroutine once every SyncInterval.
+	DurabilityPeriodic
+
+	// DurabilitySync flushes the pages touched by a write, and
+	// the file's data, before the write returns.
+	DurabilitySync
+)
+
+// default interval between background flushes
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// Options configures how a store is opened. The zero
+// value is valid and gives the default behavior.
+type Options struct {
+
+	// when writes are flushed to disk
+	Durability Durability
+
+	// interval used by DurabilityPeriodic
+	SyncInterval time.Duration
+
+	// open existing files without write access; writes fail with ErrReadOnly
+	ReadOnly bool
+
+	// how long to wait for another process to release its lock on
+	// the store's files before failing with ErrLocked; zero fails
+	// immediately. writers lock exclusively, read only opens shared
+	LockTimeout time.Duration
+
+	// how documents are compressed before they are stored
+	Compression Compression
+
+	// when set, every record is encrypted with AES-GCM using
+	// the provider's current key before it is written, and so
+	// is every batch written to the journal, keys included
+	Keys KeyProvider
+
+	// how values are encoded; see Codec. new stores record their
+	// codec in the data file header and use it whenever they are
+	// reopened. when nil, an existing store uses the codec it was
+	// created with, and a new one stores [key, value] JSON documents
+	Codec Codec
+
+	// secondary indexes to build when the store is opened, by name;
+	// see CreateIndex
+	Indexes map[string]Extractor
+
+	// unique indexes to build when the store is opened, by name;
+	// see CreateUniqueIndex
+	UniqueIndexes map[string]Extractor
+
+	// number of events buffered for each Watch subscriber;
+	// defaults to DefaultWatchBuffer
+	WatchBuffer int
+
+	// what happens to a Watch subscriber whose buffer is full
+	WatchOverflow Overflow
+
+	// number of recent events kept in memory so that subscribers
+	// can resume with WatchFrom; zero keeps none
+	ChangeLog int
+
+	// interval between background sweeps that delete expired
+	// records; see SetWithTTL. defaults to DefaultReapInterval
+	ReapInterval time.Duration
+
+	// path of the journal that makes batches atomic across crashes.
+	// OpenStore defaults it to the store's path with a .wal extension;
+	// stores created with NewStoreWith have no journal unless it is set
+	Journal string
+}
+
+// fill in defaults for anything left unset
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.ReapInterval <= 0 {
+		opts.ReapInterval = DefaultReapInterval
+	}
+	if opts.WatchBuffer <= 0 {
+		opts.WatchBuffer = DefaultWatchBuffer
+	}
+	return opts
+}
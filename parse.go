@@ -0,0 +1,376 @@
+package idx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseQuery parses a query of the form
+//
+//	SELECT * | field, ... FROM name
+//	  [WHERE condition]
+//	  [ORDER BY field [ASC | DESC], ...]
+//	  [LIMIT n] [OFFSET n]
+//
+// where a condition compares a field with a value, using one of
+// = (or ==), != (or <>), <, <=, >, >=, IN (value, ...), LIKE 'prefix%'
+// or PREFIX 'prefix', and conditions are combined with AND (or a
+// comma), OR and parentheses. Fields are dot separated paths into the
+// document, as for Path, and _key is the record's key. Values are
+// numbers, quoted strings, true, false or null; a bare word is taken
+// to be a string. Keywords are not case sensitive.
+//
+//	SELECT name, age FROM users WHERE status = 'active' AND age > 28
+//	  ORDER BY age DESC LIMIT 10
+func ParseQuery(s string) (*Query, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	return p.query()
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokNumber
+	tokString
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// split a query into tokens
+func lex(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && rune(s[j]) != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrBadQuery, i)
+			}
+			toks = append(toks, token{tokString, b.String(), i})
+			i = j + 1
+		case c >= '0' && c <= '9' || (c == '-' || c == '.') && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i + 1
+			for j < len(s) && strings.IndexByte("0123456789.eE+-", s[j]) >= 0 {
+				if (s[j] == '+' || s[j] == '-') && s[j-1] != 'e' && s[j-1] != 'E' {
+					break
+				}
+				j++
+			}
+			toks = append(toks, token{tokNumber, s[i:j], i})
+			i = j
+		case c == '_' || c == '$' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || s[j] == '$' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, token{tokWord, s[i:j], i})
+			i = j
+		default:
+			sym := s[i : i+1]
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "==", "!=", "<>", "<=", ">=":
+					sym = two
+				}
+			}
+			if strings.IndexByte("=!<>(),*", s[i]) < 0 || sym == "!" {
+				return nil, fmt.Errorf("%w: unexpected %q at %d", ErrBadQuery, sym, i)
+			}
+			toks = append(toks, token{tokSymbol, sym, i})
+			i += len(sym)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(s)}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+// reports whether the next token is the keyword, consuming it if so
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// reports whether the next token is the symbol, consuming it if so
+func (p *parser) symbol(sym string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	found := strconv.Quote(t.text)
+	if t.kind == tokEOF {
+		found = "end of query"
+	}
+	return fmt.Errorf("%w: %s at %d, found %s", ErrBadQuery, fmt.Sprintf(format, args...), t.pos, found)
+}
+
+func (p *parser) expect(kw string) error {
+	if !p.keyword(kw) {
+		return p.errorf("expected %s", kw)
+	}
+	return nil
+}
+
+func (p *parser) field() (string, error) {
+	t := p.peek()
+	if t.kind != tokWord {
+		return "", p.errorf("expected a field")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *parser) query() (*Query, error) {
+	q := &Query{}
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	if !p.symbol("*") {
+		for {
+			f, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			q.Fields = append(q.Fields, f)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	from, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	q.From = from
+	if p.keyword("WHERE") {
+		if q.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			f, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			o := Order{Field: f}
+			if p.keyword("DESC") {
+				o.Desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			q.OrderBy = append(q.OrderBy, o)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		if q.Limit, err = p.count(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("OFFSET") {
+		if q.Offset, err = p.count(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected input")
+	}
+	return q, nil
+}
+
+func (p *parser) count() (int, error) {
+	t := p.peek()
+	n, err := strconv.Atoi(t.text)
+	if t.kind != tokNumber || err != nil || n < 0 {
+		return 0, p.errorf("expected a count")
+	}
+	p.pos++
+	return n, nil
+}
+
+func (p *parser) or() (Filter, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	or := Or{f}
+	for p.keyword("OR") {
+		if f, err = p.and(); err != nil {
+			return nil, err
+		}
+		or = append(or, f)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *parser) and() (Filter, error) {
+	f, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	and := And{f}
+	for p.keyword("AND") || p.symbol(",") {
+		if f, err = p.primary(); err != nil {
+			return nil, err
+		}
+		and = append(and, f)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *parser) primary() (Filter, error) {
+	if p.symbol("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.errorf("expected )")
+		}
+		return f, nil
+	}
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	c := Cond{Field: field}
+	switch t := p.peek(); {
+	case p.keyword("IN"):
+		c.Op = OpIn
+		if !p.symbol("(") {
+			return nil, p.errorf("expected (")
+		}
+		var vals []interface{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if !p.symbol(")") {
+			return nil, p.errorf("expected )")
+		}
+		c.Value = vals
+		return c, nil
+	case p.keyword("LIKE"):
+		t := p.peek()
+		if t.kind != tokString {
+			return nil, p.errorf("expected a pattern")
+		}
+		pattern := strings.TrimSuffix(t.text, "%")
+		if strings.Contains(pattern, "%") {
+			return nil, p.errorf("only prefix patterns are supported")
+		}
+		p.pos++
+		c.Op, c.Value = OpEq, pattern
+		if pattern != t.text {
+			c.Op = OpPrefix
+		}
+		return c, nil
+	case p.keyword("PREFIX"):
+		c.Op = OpPrefix
+	case t.kind == tokSymbol:
+		ops := map[string]Op{"=": OpEq, "==": OpEq, "!=": OpNe, "<>": OpNe, "<": OpLt, "<=": OpLte, ">": OpGt, ">=": OpGte}
+		op, ok := ops[t.text]
+		if !ok {
+			return nil, p.errorf("expected a comparison")
+		}
+		p.pos++
+		c.Op = op
+	default:
+		return nil, p.errorf("expected a comparison")
+	}
+	if c.Value, err = p.value(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *parser) value() (interface{}, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokString:
+		p.pos++
+		return t.text, nil
+	case tokNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			p.pos++
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("bad number")
+		}
+		p.pos++
+		return f, nil
+	case tokWord:
+		p.pos++
+		switch strings.ToLower(t.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.text, nil
+	}
+	return nil, p.errorf("expected a value")
+}
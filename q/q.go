@@ -0,0 +1,113 @@
+// Package q builds filters for finding documents in an idx store:
+//
+//	var users []User
+//	err := st.Find(q.And(q.Eq("status", "active"), q.Gt("age", 28)), &users)
+//
+// Fields are dot separated paths into a document, such as "address.city",
+// and numbers of any type compare by value. Filters on fields covered by
+// a Path index are answered from the index. Aggregates are built the
+// same way:
+//
+//	rows, err := st.Aggregate(q.Eq("status", "active"), []string{"city"},
+//		q.Count(), q.Avg("age"))
+package q
+
+import "github.com/cagnosolutions/idx"
+
+// Eq matches documents whose field equals v.
+func Eq(field string, v interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpEq, Value: v}
+}
+
+// Ne matches documents whose field does not equal v, including
+// those without the field.
+func Ne(field string, v interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpNe, Value: v}
+}
+
+// Lt matches documents whose field is less than v.
+func Lt(field string, v interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpLt, Value: v}
+}
+
+// Lte matches documents whose field is less than or equal to v.
+func Lte(field string, v interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpLte, Value: v}
+}
+
+// Gt matches documents whose field is greater than v.
+func Gt(field string, v interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpGt, Value: v}
+}
+
+// Gte matches documents whose field is greater than or equal to v.
+func Gte(field string, v interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpGte, Value: v}
+}
+
+// In matches documents whose field equals any of vals.
+func In(field string, vals ...interface{}) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpIn, Value: vals}
+}
+
+// Prefix matches documents whose field is a string starting with p.
+func Prefix(field string, p string) idx.Filter {
+	return idx.Cond{Field: field, Op: idx.OpPrefix, Value: p}
+}
+
+// Key matches documents whose key compares with k as op does; it is
+// answered by scanning just the matching range of keys.
+func Key(op idx.Op, k string) idx.Filter {
+	return idx.Cond{Field: idx.KeyField, Op: op, Value: k}
+}
+
+// And matches documents matching all of filters.
+func And(filters ...idx.Filter) idx.Filter {
+	return idx.And(filters)
+}
+
+// Or matches documents matching any of filters.
+func Or(filters ...idx.Filter) idx.Filter {
+	return idx.Or(filters)
+}
+
+// Not matches documents that f does not.
+func Not(f idx.Filter) idx.Filter {
+	return Func(func(doc interface{}) bool {
+		return !f.Match(doc)
+	})
+}
+
+// Func matches documents fn returns true for. fn is handed each
+// document decoded into an interface{}, so it can test anything,
+// but finding with it always scans the whole store.
+type Func func(doc interface{}) bool
+
+func (fn Func) Match(doc interface{}) bool {
+	return fn(doc)
+}
+
+// Count counts the documents in each group.
+func Count() idx.Agg {
+	return idx.Agg{Op: idx.AggCount}
+}
+
+// Sum adds up the numeric values of field in each group.
+func Sum(field string) idx.Agg {
+	return idx.Agg{Op: idx.AggSum, Field: field}
+}
+
+// Avg averages the numeric values of field in each group.
+func Avg(field string) idx.Agg {
+	return idx.Agg{Op: idx.AggAvg, Field: field}
+}
+
+// Min finds the smallest value of field in each group.
+func Min(field string) idx.Agg {
+	return idx.Agg{Op: idx.AggMin, Field: field}
+}
+
+// Max finds the largest value of field in each group.
+func Max(field string) idx.Agg {
+	return idx.Agg{Op: idx.AggMax, Field: field}
+}
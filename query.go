@@ -0,0 +1,415 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// Query selects documents from a store; see ParseQuery.
+type Query struct {
+	Fields  []string // fields to return, or nil for whole documents
+	From    string   // name of the store queried
+	Where   Filter   // nil matches every document
+	OrderBy []Order  // documents are returned in key order otherwise
+	Offset  int      // number of matching documents to skip
+	Limit   int      // most documents to return, 0 for no limit
+}
+
+// Order sorts query results by a field.
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// Query parses and runs a query against the store, appending the
+// documents it selects to the slice ptr points to. See ParseQuery for
+// the syntax; the store name given in FROM is not checked, since the
+// query always runs against st.
+func (st *Store) Query(query string, ptr interface{}) error {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	return st.Run(q, ptr)
+}
+
+// Find appends every document matching f to the slice ptr points to,
+// in key order. It runs the same way as a query; see Run. Filters are
+// most easily built with package q.
+func (st *Store) Find(f Filter, ptr interface{}) error {
+	return st.Run(&Query{Where: f}, ptr)
+}
+
+// Run runs a parsed query against the store, appending the documents
+// it selects to the slice ptr points to. Whole documents are decoded
+// with the store's codec; in stores without one, that is just the
+// value, not the [key, value] array Get returns. When the query names
+// the fields to return, each document is instead a map of those
+// fields, converted to the slice's element type through JSON if it is
+// not a map[string]interface{} or interface{}.
+//
+// When the filter compares fields covered by a Path index, or the
+// KeyField, only the records it could match are read; otherwise the
+// whole store is scanned. The store is read locked while a query runs.
+//
+// Filtering, projecting and ordering all work on documents decoded
+// into an interface{}, which values written with GobCodec or RawCodec
+// can't be; such queries fail with ErrNotDocument on those stores.
+func (st *Store) Run(q *Query, ptr interface{}) error {
+	out := reflect.ValueOf(ptr)
+	if out.Kind() != reflect.Ptr || out.Elem().Kind() != reflect.Slice {
+		return ErrNonSlice
+	}
+	out = out.Elem()
+	emit := func(h *hit) error {
+		elem := reflect.New(out.Type().Elem())
+		var err error
+		if q.Fields == nil {
+			err = st.value(h.rec, elem.Interface())
+		} else {
+			err = assign(elem.Elem(), project(h.doc, q.Fields))
+		}
+		if err != nil {
+			return err
+		}
+		out.Set(reflect.Append(out, elem.Elem()))
+		return nil
+	}
+
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return ErrClosed
+	}
+	var hits []*hit
+	var err error
+	skip, n := q.Offset, 0
+	docs := q.Where != nil || q.Fields != nil || len(q.OrderBy) > 0
+	if serr := st.search(q.Where, docs, func(h *hit) bool {
+		switch {
+		case len(q.OrderBy) > 0:
+			hits = append(hits, h) // sorted once they are all in
+		case skip > 0:
+			skip--
+		default:
+			if err = emit(h); err != nil {
+				return false
+			}
+			n++
+		}
+		return q.Limit <= 0 || n < q.Limit
+	}); serr != nil {
+		return serr
+	}
+	if err != nil || len(q.OrderBy) == 0 {
+		return err
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		for _, o := range q.OrderBy {
+			a, aok := lookup(hits[i].doc, Path(o.Field).parts())
+			b, bok := lookup(hits[j].doc, Path(o.Field).parts())
+			if c := order(a, aok, b, bok); c != 0 {
+				return c < 0 != o.Desc
+			}
+		}
+		return false
+	})
+	if q.Offset >= len(hits) {
+		return nil
+	}
+	hits = hits[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(hits) {
+		hits = hits[:q.Limit]
+	}
+	for _, h := range hits {
+		if err := emit(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a document matched by a search
+type hit struct {
+	key, rec []byte
+	doc      interface{}
+}
+
+// call fn, in key order, for every document matching f (all of them
+// if f is nil) until fn returns false, decoding each hit's doc if docs
+// is set, as it must be for f; must hold the read lock
+func (st *Store) search(f Filter, docs bool, fn func(h *hit) bool) error {
+	if (docs || f != nil) && !st.documents() {
+		return ErrNotDocument
+	}
+	visit := func(k []byte, n int) (bool, error) {
+		if st.expired(k) {
+			return true, nil
+		}
+		rec, err := st.engine.Get(n)
+		if err != nil {
+			return false, err
+		}
+		h := &hit{key: k, rec: rec}
+		if !docs && f == nil {
+			return fn(h), nil
+		}
+		if err := st.value(rec, &h.doc); err != nil {
+			return false, err
+		}
+		if m, ok := h.doc.(map[string]interface{}); ok {
+			m[KeyField] = string(k)
+		}
+		if f != nil && !f.Match(h.doc) {
+			return true, nil
+		}
+		return fn(h), nil
+	}
+	if keys, ok := st.plan(f); ok {
+		for _, k := range keys {
+			r := st.index.Get(k)
+			if r == nil {
+				continue
+			}
+			if more, err := visit(k, int(Btoi(r.Val))); !more || err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer st.scanning()()
+	var err error
+	st.index.Ascend(nil, func(r *Record) bool {
+		var more bool
+		more, err = visit(r.Key, int(Btoi(r.Val)))
+		return more && err == nil
+	})
+	return err
+}
+
+// work out which keys could match a filter using secondary indexes
+// and key ranges, returning them in order; false if it can't be done
+// and the store has to be scanned
+func (st *Store) plan(f Filter) ([][]byte, bool) {
+	switch f := f.(type) {
+	case Cond:
+		return st.planCond(f)
+	case *Cond:
+		return st.planCond(*f)
+	case And:
+		// go with whichever filter narrows things down the most
+		var best [][]byte
+		found := false
+		for _, sub := range f {
+			if keys, ok := st.plan(sub); ok && (!found || len(keys) < len(best)) {
+				best, found = keys, true
+			}
+		}
+		return best, found
+	case Or:
+		var all [][]byte
+		for _, sub := range f {
+			keys, ok := st.plan(sub)
+			if !ok {
+				return nil, false
+			}
+			all = append(all, keys...)
+		}
+		return sortKeys(all), len(f) > 0
+	}
+	return nil, false
+}
+
+func (st *Store) planCond(c Cond) ([][]byte, bool) {
+	vals := []interface{}{c.Value}
+	if c.Op == OpIn {
+		var ok bool
+		if vals, ok = c.Value.([]interface{}); !ok {
+			return nil, true // matches nothing
+		}
+	}
+	op := c.Op
+	if op == OpIn {
+		op = OpEq
+	}
+	if op == OpNe {
+		return nil, false
+	}
+	if Path(c.Field).String() == KeyField {
+		var keys [][]byte
+		for _, v := range vals {
+			b, ok := text(v)
+			if !ok {
+				continue // never matches a key
+			}
+			keys = append(keys, scanRange(st.index, op, b, nil, true)...)
+		}
+		return sortKeys(keys), true
+	}
+	ix := st.pathIndex(c.Field)
+	if ix == nil {
+		return nil, false
+	}
+	var keys [][]byte
+	for _, v := range vals {
+		b, ok := indexValue(v)
+		if !ok {
+			return nil, false // not indexed, like nulls
+		}
+		encs := [][]byte{b}
+		if s, ok := text(v); ok {
+			// strings and byte slices compare with each other
+			encs = [][]byte{indexBytes(ixString, s), indexBytes(ixBytes, s)}
+			if op == OpPrefix {
+				for i, b := range encs {
+					encs[i] = b[:len(b)-2] // drop the terminator
+				}
+			}
+		} else if op == OpPrefix {
+			continue // only text has a prefix
+		}
+		for _, b := range encs {
+			keys = append(keys, scanRange(ix.tree, op, b, b[:1], false)...)
+		}
+	}
+	return sortKeys(keys), true
+}
+
+// find a secondary index on the field at a path
+func (st *Store) pathIndex(field string) *fieldIndex {
+	want := Path(field).String()
+	for _, ix := range st.indexes {
+		if p, ok := ix.extract.(Path); ok && p.String() == want {
+			return ix
+		}
+	}
+	return nil
+}
+
+// returns the keys held by the entries of t that compare with v as op
+// does. entries are keyed by the encoded value, and are limited to
+// those starting with within, unless primary is set, in which case
+// the tree is the primary index and v a plain key
+func scanRange(t *Tree, op Op, v, within []byte, primary bool) [][]byte {
+	var keys [][]byte
+	take := func(r *Record) {
+		if primary {
+			keys = append(keys, append([]byte(nil), r.Key...))
+		} else {
+			keys = append(keys, append([]byte(nil), r.Val...))
+		}
+	}
+	start := v
+	if op == OpLt || op == OpLte {
+		start = within
+	}
+	t.Ascend(start, func(r *Record) bool {
+		if !bytes.HasPrefix(r.Key, within) {
+			return false
+		}
+		// an entry's key is its value followed by the record's key
+		same := bytes.HasPrefix(r.Key, v) && (!primary || len(r.Key) == len(v))
+		switch op {
+		case OpEq:
+			if !same {
+				return false
+			}
+		case OpPrefix:
+			if !bytes.HasPrefix(r.Key, v) {
+				return false
+			}
+		case OpGt:
+			if same {
+				return true
+			}
+		case OpLt:
+			if same || bytes.Compare(r.Key, v) > 0 {
+				return false
+			}
+		case OpLte:
+			if !same && bytes.Compare(r.Key, v) > 0 {
+				return false
+			}
+		}
+		take(r)
+		return true
+	})
+	return keys
+}
+
+// sort keys and drop any duplicates
+func sortKeys(keys [][]byte) [][]byte {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	out := keys[:0]
+	for i, k := range keys {
+		if i == 0 || !bytes.Equal(k, keys[i-1]) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// order two possibly missing values for sorting. unlike compare, this
+// orders everything: missing values first, then by kind, then by value
+func order(a interface{}, aok bool, b interface{}, bok bool) int {
+	switch {
+	case !aok || !bok:
+		return rank(aok) - rank(bok)
+	}
+	if n, ok := compare(a, b); ok {
+		return n
+	}
+	return kind(a) - kind(b)
+}
+
+func rank(ok bool) int {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// the order kinds of values sort in when they can't be compared
+func kind(v interface{}) int {
+	if v == nil {
+		return 0
+	}
+	if _, ok := v.(bool); ok {
+		return 1
+	}
+	if _, ok := number(v); ok {
+		return 2
+	}
+	if _, ok := text(v); ok {
+		return 3
+	}
+	return 4
+}
+
+// pick the named fields out of a document
+func project(doc interface{}, fields []string) map[string]interface{} {
+	m := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if v, ok := lookup(doc, Path(f).parts()); ok {
+			m[f] = v
+		}
+	}
+	return m
+}
+
+// set dst to v, converting it through JSON if the types differ
+func assign(dst reflect.Value, v interface{}) error {
+	if rv := reflect.ValueOf(v); rv.Type().AssignableTo(dst.Type()) {
+		dst.Set(rv)
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst.Addr().Interface())
+}
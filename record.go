@@ -0,0 +1,296 @@
+package idx
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Each page holds a single record. Older stores wrote the encoded
+// document straight into the page; records are now framed with a
+// small header describing how the payload is stored:
+//
+//	magic[1] flags[1] length[2] [expires[8]] [version[8]] [rawlen[4]] [keyid[4] nonce[12]] payload[length]
+//
+// expires is only present for records written with a time to live,
+// and holds the time they expire in Unix nanoseconds. version is set
+// when the record is committed, see SetIf; records written before it
+// was added are version 1. rawlen is only present when the payload is
+// compressed, and holds the size of the document before compression.
+// keyid and nonce are only present when the payload is encrypted, in
+// which case everything before the payload is authenticated along
+// with it. Pages are padded with null bytes, which engines strip, so
+// the payload is re-padded to length when the record is read back.
+const (
+	recMagic  = 0xa1
+	recHeader = 4
+
+	// compression algorithm, in the low bits of the flags
+	recFlate    = 0x01
+	recCompress = 0x03
+
+	// payload is encrypted with AES-GCM
+	recCrypt = 0x04
+
+	// record has an expiry time
+	recExpires = 0x08
+
+	// record has a version
+	recVersion = 0x10
+
+	// size of the authentication tag appended by AES-GCM
+	gcmTag = 16
+)
+
+// Compression selects how record payloads are compressed.
+type Compression int
+
+const (
+	// CompressNone stores documents as they are.
+	CompressNone Compression = iota
+
+	// CompressFlate compresses documents with DEFLATE, using the
+	// fastest setting. Documents that do not shrink are stored as is.
+	CompressFlate
+)
+
+// documents smaller than this are never worth compressing
+const minCompress = 64
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// what a record's header says about it, apart from how it is stored
+type meta struct {
+	expires int64  // Unix nanoseconds, or 0 if the record never expires
+	version uint64 // see SetIf
+}
+
+// frame a document into a record according to the store's options,
+// failing with ErrTooLarge if the record will not fit in a page
+func (st *Store) frame(doc []byte, m meta) ([]byte, error) {
+	flags := byte(recVersion)
+	payload, ext := doc, []byte(nil)
+	if m.expires != 0 {
+		flags |= recExpires
+		ext = binary.BigEndian.AppendUint64(ext, uint64(m.expires))
+	}
+	ext = binary.BigEndian.AppendUint64(ext, m.version)
+	if st.opts.Compression == CompressFlate && len(doc) >= minCompress {
+		if z, err := deflate(doc); err == nil && len(z) < len(doc) {
+			flags |= recFlate
+			payload = z
+			ext = binary.BigEndian.AppendUint32(ext, uint32(len(doc)))
+		}
+	}
+	size, n := len(payload), recHeader+len(ext)
+	if st.opts.Keys != nil {
+		flags |= recCrypt
+		size += gcmTag
+		n += recCryptExt
+	}
+	if n+size > SYS_PAGE {
+		return nil, ErrTooLarge
+	}
+	rec := make([]byte, recHeader, n+size)
+	rec[0], rec[1] = recMagic, flags
+	binary.BigEndian.PutUint16(rec[2:], uint16(size))
+	rec = append(rec, ext...)
+	if flags&recCrypt != 0 {
+		var err error
+		if ext, payload, err = st.seal(rec, payload); err != nil {
+			return nil, err
+		}
+		rec = append(rec, ext...)
+	}
+	return append(rec, payload...), nil
+}
+
+// set the version of a framed record, sealing its payload again if it
+// is encrypted, since the version is authenticated with it
+func (st *Store) restamp(rec []byte, version uint64) ([]byte, error) {
+	h, err := parseRecord(rec)
+	if err != nil || h.flags&recVersion == 0 {
+		return rec, err // only bare documents lack room for one
+	}
+	off := recHeader
+	if h.flags&recExpires != 0 {
+		off += 8
+	}
+	if h.flags&recCrypt == 0 {
+		binary.BigEndian.PutUint64(rec[off:], version)
+		return rec, nil
+	}
+	n := len(h.ad) - recCryptExt
+	payload, err := st.open(h.ad, h.ad[n:], h.payload)
+	if err != nil {
+		return nil, err
+	}
+	hdr := append([]byte(nil), h.ad[:n]...)
+	binary.BigEndian.PutUint64(hdr[off:], version)
+	ext, payload, err := st.seal(hdr, payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(hdr, ext...), payload...), nil
+}
+
+// return the document held by a record
+func (st *Store) unframe(rec []byte) ([]byte, error) {
+	h, err := parseRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	payload := h.payload
+	if h.flags&recCrypt != 0 {
+		if payload, err = st.open(h.ad, h.ad[len(h.ad)-recCryptExt:], payload); err != nil {
+			return nil, err
+		}
+	}
+	switch h.flags & recCompress {
+	case 0:
+		return payload, nil
+	case recFlate:
+		return inflate(payload, h.rawlen)
+	}
+	return nil, fmt.Errorf("%w: unknown compression %d", ErrBadRecord, h.flags&recCompress)
+}
+
+// the decoded header of a record
+type record struct {
+	flags   byte
+	rawlen  int    // document size before compression
+	size    int    // record size as stored
+	keyID   uint32 // id of the key the payload is encrypted with
+	ad      []byte // header bytes, authenticated when encrypted
+	payload []byte
+	meta
+}
+
+func parseRecord(rec []byte) (*record, error) {
+	if len(rec) > 0 && rec[0] == '[' {
+		// bare document written before records were framed
+		return &record{rawlen: len(rec), size: len(rec), payload: rec, meta: meta{version: 1}}, nil
+	}
+	if len(rec) < recHeader || rec[0] != recMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrBadRecord)
+	}
+	h := &record{flags: rec[1]}
+	n, off := int(binary.BigEndian.Uint16(rec[2:])), recHeader
+	if h.flags&recExpires != 0 {
+		if len(rec) < off+8 {
+			return nil, fmt.Errorf("%w: short header", ErrBadRecord)
+		}
+		h.expires = int64(binary.BigEndian.Uint64(rec[off:]))
+		off += 8
+	}
+	h.version = 1
+	if h.flags&recVersion != 0 {
+		if len(rec) < off+8 {
+			return nil, fmt.Errorf("%w: short header", ErrBadRecord)
+		}
+		h.version = binary.BigEndian.Uint64(rec[off:])
+		off += 8
+	}
+	if h.flags&recCompress != 0 {
+		if len(rec) < off+4 {
+			return nil, fmt.Errorf("%w: short header", ErrBadRecord)
+		}
+		h.rawlen = int(binary.BigEndian.Uint32(rec[off:]))
+		off += 4
+	} else {
+		h.rawlen = n
+	}
+	if h.flags&recCrypt != 0 {
+		if len(rec) < off+recCryptExt || n < gcmTag {
+			return nil, fmt.Errorf("%w: short header", ErrBadRecord)
+		}
+		h.keyID = binary.BigEndian.Uint32(rec[off:])
+		off += recCryptExt
+		if h.flags&recCompress == 0 {
+			h.rawlen = n - gcmTag
+		}
+	}
+	h.ad = rec[:off:off]
+	h.size = off + n
+	if len(rec) > h.size {
+		return nil, fmt.Errorf("%w: bad length", ErrBadRecord)
+	}
+	// put back any trailing null bytes lost to page stripping
+	rec = append(rec[:len(rec):len(rec)], make([]byte, h.size-len(rec))...)
+	h.payload = rec[off:]
+	return h, nil
+}
+
+func deflate(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(b []byte, n int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	doc := make([]byte, n)
+	if _, err := io.ReadFull(r, doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRecord, err)
+	}
+	return doc, nil
+}
+
+// Stats describes the records held by a store.
+type Stats struct {
+	Records     int   // number of records
+	Bytes       int64 // size of the documents before compression
+	StoredBytes int64 // size of the records as stored, headers included
+}
+
+// CompressionRatio returns how many times smaller the stored
+// records are than the documents they hold.
+func (s Stats) CompressionRatio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.Bytes) / float64(s.StoredBytes)
+}
+
+// Stats walks the store's records, reading only their headers, and
+// reports how many there are and how well they have compressed.
+func (st *Store) Stats() (Stats, error) {
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return Stats{}, ErrClosed
+	}
+	defer st.scanning()()
+	var s Stats
+	for _, v := range st.index.All() {
+		b, err := st.engine.Get(int(Btoi(v)))
+		if err != nil {
+			return s, err
+		}
+		h, err := parseRecord(b)
+		if err != nil {
+			return s, err
+		}
+		s.Records++
+		s.Bytes += int64(h.rawlen)
+		s.StoredBytes += int64(h.size)
+	}
+	return s, nil
+}
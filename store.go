@@ -3,91 +3,499 @@ package idx
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	ErrTooLarge  = errors.New("key and value data is too large; maximum limit of 4KB")
-	ErrStoreFull = errors.New("maximum number of records was reached; store is full")
-	ErrNotFound  = errors.New("could not locate; not found")
-	ErrNonPtrVal = errors.New("expected pointer to value, not value")
-	ErrExists    = errors.New("key or value already exists")
+	ErrTooLarge        = errors.New("key and value data is too large; maximum limit of 4KB")
+	ErrStoreFull       = errors.New("maximum number of records was reached; store is full")
+	ErrNotFound        = errors.New("could not locate; not found")
+	ErrNonPtrVal       = errors.New("expected pointer to value, not value")
+	ErrExists          = errors.New("key or value already exists")
+	ErrReadOnly        = errors.New("store was opened read only")
+	ErrLocked          = errors.New("file is locked by another process")
+	ErrBadBackup       = errors.New("backup is corrupt or incomplete")
+	ErrBadRecord       = errors.New("record is corrupt")
+	ErrNoKey           = errors.New("encryption key is not available")
+	ErrTxClosed        = errors.New("transaction has already finished")
+	ErrTxRead          = errors.New("cannot write in a read only transaction")
+	ErrConflict        = errors.New("transaction conflicts with a concurrent commit")
+	ErrCodec           = errors.New("store was written with a different codec")
+	ErrNoIndex         = errors.New("no such index")
+	ErrNonSlice        = errors.New("expected pointer to slice")
+	ErrBadQuery        = errors.New("query is malformed")
+	ErrSeqGone         = errors.New("change log no longer holds the sequence number")
+	ErrVersionMismatch = errors.New("record has changed since the expected version")
+	ErrUnmapped        = errors.New("data file is no longer mapped")
+	ErrClosed          = errors.New("store is closed")
+	ErrNotDocument     = errors.New("codec cannot decode values as documents")
 )
 
 type Store struct {
-	index  *Tree
-	engine *MappedData
+	index    *Tree
+	indexes  map[string]*fieldIndex // secondary indexes by name
+	engine   Engine
+	opts     Options
+	codec    Codec                   // nil for [key, value] JSON documents
+	done     chan struct{}           // signals background work to stop
+	wg       sync.WaitGroup          // tracks background work
+	err      error                   // first error hit by background work
+	backups  map[*snapshot]struct{}  // backups that are currently running
+	scans    int32                   // scans in progress, see scanning
+	journal  *journal                // makes multi key commits atomic
+	clock    uint64                  // timestamp of the last commit, see mvcc.go
+	history  map[string][]*version   // replaced records kept for snapshots
+	versions []*version              // the same records, oldest first
+	snaps    map[uint64]int          // active snapshots by timestamp
+	snapmu   sync.Mutex              // guards snaps
+	watchers map[chan Event]*watcher // Watch subscribers
+	changes  []Event                 // recent events, see Options.ChangeLog
+	seq      uint64                  // sequence number of the last event
+	closed   bool                    // see Close
+	ttl      map[string]int64        // expiry times of records that have one
+	expiring *Tree                   // the same keys, ordered by expiry time
+	vmax     uint64                  // highest record version given out, see stamp
 	sync.RWMutex
 }
 
-func NewStore(path string) *Store {
-	st := &Store{}
+func NewStore(path string) (*Store, error) {
+	return OpenStore(path, nil)
+}
+
+// OpenStore opens the store at path, creating it if needed, using
+// the supplied options. A nil opts is the same as calling NewStore.
+func OpenStore(path string, opts *Options) (*Store, error) {
+	o := opts.withDefaults()
+	if o.Journal == "" {
+		o.Journal = path + ".wal"
+	}
+	engine, err := OpenMappedDataWith(path, &o)
+	if err != nil {
+		return nil, err
+	}
+	st, err := NewStoreWith(engine, &o)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// NewStoreWith returns a store that keeps its records in the supplied
+// engine, indexing any records the engine already holds. The store
+// takes ownership of the engine and closes it when it is closed.
+func NewStoreWith(engine Engine, opts *Options) (*Store, error) {
+	st := &Store{opts: opts.withDefaults()}
 	st.index = NewTree()
-	st.engine = OpenMappedData(path)
-	for key, page := range st.engine.All() {
-		st.index.Set([]byte(key), Itob(int64(page)))
+	st.engine = engine
+	st.backups = make(map[*snapshot]struct{})
+	st.history = make(map[string][]*version)
+	st.snaps = make(map[uint64]int)
+	st.indexes = make(map[string]*fieldIndex)
+	st.watchers = make(map[chan Event]*watcher)
+	st.ttl = make(map[string]int64)
+	st.expiring = NewTree()
+	if err := st.setCodec(); err != nil {
+		return nil, err
+	}
+	// a commit left in the journal may have torn the pages it was
+	// writing, so it is read first; see load
+	var pending []*op
+	if st.opts.Journal != "" && !st.opts.ReadOnly {
+		var err error
+		if st.journal, err = openJournal(st.opts.Journal); err != nil {
+			return nil, err
+		}
+		if st.opts.Keys != nil {
+			st.journal.seal, st.journal.open = st.seal, st.open
+		}
+		if pending, err = st.journal.read(); err != nil {
+			st.journal.close()
+			return nil, err
+		}
+	}
+	done := st.scanning()
+	err := st.load(len(pending) > 0)
+	done()
+	if err == nil && st.journal != nil {
+		err = st.recover(pending)
+	}
+	if err != nil {
+		if st.journal != nil {
+			st.journal.close()
+		}
+		return nil, err
 	}
-	return st
+	st.seedVersion()
+	st.seq = uint64(time.Now().UnixNano()) // see WatchFrom
+	for i, indexes := range []map[string]Extractor{st.opts.Indexes, st.opts.UniqueIndexes} {
+		for name, fn := range indexes {
+			if err := st.createIndex(name, fn, i == 1); err != nil {
+				if st.journal != nil {
+					st.journal.close()
+				}
+				return nil, err
+			}
+		}
+	}
+	st.done = make(chan struct{})
+	if st.opts.Durability == DurabilityPeriodic && !st.opts.ReadOnly {
+		st.wg.Add(1)
+		go st.flusher()
+	}
+	if !st.opts.ReadOnly {
+		st.wg.Add(1)
+		go st.reaper()
+	}
+	return st, nil
 }
 
-func (st *Store) Add(k []byte, v interface{}) error {
-	st.Lock()
-	defer st.Unlock()
-	if !st.index.Has(k) {
-		doc, err := encode(string(k), v)
-		if err != nil {
+// rebuild the index from the records held by the engine. when torn is
+// set a crash cut short the commit left in the journal, so pages that
+// are corrupt are ones it was writing; they are freed, as applying the
+// commit again writes them afresh
+func (st *Store) load(torn bool) error {
+	var err error
+	var free []int
+	if rerr := st.engine.Range(func(n int, b []byte) bool {
+		var k []byte
+		if k, err = st.key(b); err != nil {
+			if torn && errors.Is(err, ErrBadRecord) {
+				free, err = append(free, n), nil
+				return true
+			}
+			err = fmt.Errorf("page %d: %w", n, err)
+			return false
+		}
+		st.index.Set(k, Itob(int64(n)))
+		st.track(k, b)
+		return true
+	}); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return err
+	}
+	for _, n := range free {
+		if err := st.engine.Del(n); err != nil {
 			return err
 		}
-		page := st.engine.Add(doc)
-		if page == -1 {
-			return ErrStoreFull
+	}
+	return nil
+}
+
+// hint to the engine that the store is about to scan through it. the
+// returned func switches back to random access, which suits point
+// reads, once the last running scan is done. both must be called with
+// the lock held; hints are only advisory, so errors are ignored
+func (st *Store) scanning() func() {
+	a, ok := st.engine.(Adviser)
+	if !ok {
+		return func() {}
+	}
+	if atomic.AddInt32(&st.scans, 1) == 1 {
+		a.Advise(syscall.MADV_SEQUENTIAL)
+	}
+	return func() {
+		if atomic.AddInt32(&st.scans, -1) == 0 {
+			a.Advise(syscall.MADV_RANDOM)
 		}
-		st.index.Set(k, Itob(int64(page)))
-		return nil
 	}
-	return ErrExists
 }
 
-func (st *Store) Set(k []byte, v interface{}) error {
+// Residency reports how much of the store's data is held in memory.
+// Only memory mapped engines support it; others fail with
+// errors.ErrUnsupported.
+func (st *Store) Residency() (Residency, error) {
+	a, ok := st.engine.(Adviser)
+	if !ok {
+		return Residency{}, errors.ErrUnsupported
+	}
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return Residency{}, ErrClosed
+	}
+	return a.Residency()
+}
+
+// OpenReadOnly opens an existing store without write access. It never
+// creates missing files, and every write to it returns ErrReadOnly.
+func OpenReadOnly(path string) (*Store, error) {
+	return OpenStore(path, &Options{ReadOnly: true})
+}
+
+// flushes dirty pages in the background until the store is closed
+func (st *Store) flusher() {
+	defer st.wg.Done()
+	t := time.NewTicker(st.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-st.done:
+			return
+		case <-t.C:
+			st.Lock()
+			finish := st.flush()
+			st.Unlock()
+			if err := finish(); err != nil {
+				st.Lock()
+				if st.err == nil {
+					st.err = err
+				}
+				st.Unlock()
+			}
+		}
+	}
+}
+
+// start syncing the engine, returning a func that finishes the
+// job without the lock held; must hold the lock
+func (st *Store) flush() func() error {
+	if f, ok := st.engine.(Flusher); ok {
+		return f.Flush()
+	}
+	err := st.engine.Sync()
+	return func() error { return err }
+}
+
+// write barrier; flushes the pages touched by
+// a write when running with DurabilitySync
+func (st *Store) barrier() error {
+	if st.opts.Durability == DurabilitySync {
+		return st.engine.Sync()
+	}
+	return nil
+}
+
+// Sync flushes all outstanding writes to disk,
+// regardless of the store's durability mode.
+func (st *Store) Sync() error {
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.engine.Sync()
+}
+
+// Close stops any background work, flushes outstanding writes
+// according to the durability mode and closes the data file.
+// It returns the first error hit by background work, if any.
+// Once closed, every other method fails with ErrClosed, and
+// closing the store again does nothing.
+func (st *Store) Close() error {
+	st.Lock()
+	if st.closed {
+		st.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.unwatchAll()
+	st.Unlock()
+	close(st.done)
+	st.wg.Wait()
 	st.Lock()
 	defer st.Unlock()
-	doc, err := encode(string(k), v)
+	err := st.err
+	if st.opts.Durability != DurabilityNone {
+		if serr := st.engine.Sync(); err == nil {
+			err = serr
+		}
+	}
+	if st.journal != nil {
+		if jerr := st.journal.close(); err == nil {
+			err = jerr
+		}
+	}
+	if cerr := st.engine.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (st *Store) Add(k []byte, v interface{}) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	rec, err := st.record(k, v)
 	if err != nil {
 		return err
 	}
-	rec := st.index.Get(k)
-	if rec != nil {
-		st.engine.Set(rec.Val, doc)
-		return nil
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
 	}
-	page := st.engine.Add(doc)
-	if page == -1 {
-		return ErrStoreFull
+	if st.index.Has(k) && !st.expired(k) {
+		return ErrExists
 	}
-	rec.Key = k
-	rec.Val = page
-	return nil
+	return st.commit([]*op{{key: k, rec: rec}})
+}
+
+func (st *Store) Set(k []byte, v interface{}) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	rec, err := st.record(k, v)
+	if err != nil {
+		return err
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.commit([]*op{{key: k, rec: rec}})
 }
 
 func (st *Store) Get(k []byte, ptr interface{}) error {
 	st.RLock()
 	defer st.RUnlock()
-	if r := st.index.Get(k); r != nil {
-		if v := st.engine.Get(r.Val); v != nil {
-			if err := decode(v, ptr); err != nil {
-				return err
+	if st.closed {
+		return ErrClosed
+	}
+	return st.get(k, ptr)
+}
+
+// look up a key and decode its value; must hold the lock
+func (st *Store) get(k []byte, ptr interface{}) error {
+	rec, err := st.current(k)
+	if err != nil {
+		return err
+	}
+	if rec == nil || st.expired(k) {
+		return ErrNotFound
+	}
+	return st.unmarshal(rec, ptr)
+}
+
+// decode the value held by a record into ptr
+func (st *Store) unmarshal(rec []byte, ptr interface{}) error {
+	doc, err := st.unframe(rec)
+	if err != nil {
+		return err
+	}
+	if st.codec == nil {
+		return decode(doc, ptr)
+	}
+	if reflect.ValueOf(ptr).Kind() != reflect.Ptr {
+		return ErrNonPtrVal
+	}
+	_, val, err := unpack(doc)
+	if err != nil {
+		return err
+	}
+	return st.codec.Unmarshal(val, ptr)
+}
+
+func (st *Store) Del(k []byte) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.commit([]*op{{key: k}})
+}
+
+// Compact performs a single incremental compaction step, relocating
+// at most n live pages toward the front of the data file and updating
+// the index to point at their new location. The store is only locked
+// for the duration of the step, so it can be called repeatedly while
+// the store is in use. It returns true once the file is fully compacted.
+func (st *Store) Compact(n int) (bool, error) {
+	if st.opts.ReadOnly {
+		return false, ErrReadOnly
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return false, ErrClosed
+	}
+	c, ok := st.engine.(Compacter)
+	if !ok {
+		return true, nil // nothing to do
+	}
+	done, err := c.Compact(n, func(from, to int) error {
+		b, err := st.engine.Get(from)
+		if err != nil {
+			return err
+		}
+		k, err := st.key(b)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", from, err)
+		}
+		// only follow pages the index still points at; anything
+		// else is a stale record that was removed from the index
+		if r := st.index.Get(k); r != nil && Btoi(r.Val) == int64(from) {
+			r.Val = Itob(int64(to))
+		}
+		// running backups still know the page by its old number
+		for snap := range st.backups {
+			if _, ok := snap.saved[from]; !ok && snap.pending[from] {
+				snap.saved[from] = b
 			}
-			return nil
 		}
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	return ErrNotFound
+	return done, st.barrier()
 }
 
-func (st *Store) Del(k []byte) {
+// Compactor runs Compact in the background, relocating at most n
+// pages every interval, until the returned stop function is called or
+// the store is closed. Compaction halts on the first error, which is
+// returned by stop.
+func (st *Store) Compactor(every time.Duration, n int) func() error {
+	done, errc := make(chan struct{}), make(chan error, 1)
 	st.Lock()
-	st.index.Del(k)
-	st.Unlock()
+	defer st.Unlock()
+	if st.closed {
+		return func() error { return ErrClosed }
+	}
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				errc <- nil
+				return
+			case <-st.done:
+				errc <- nil
+				return
+			case <-t.C:
+				if _, err := st.Compact(n); err == ErrClosed {
+					errc <- nil
+					return
+				} else if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			close(done)
+			err = <-errc
+		})
+		return err
+	}
 }
 
 /*
@@ -110,12 +518,31 @@ func encode(k string, v interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(b) > SYS_PAGE {
-		return nil, ErrTooLarge
-	}
 	return b, nil
 }
 
+// encode a key value pair into a record ready to be written to a page
+func (st *Store) record(k []byte, v interface{}) ([]byte, error) {
+	doc, err := st.pack(k, v)
+	if err != nil {
+		return nil, err
+	}
+	return st.frame(doc, meta{})
+}
+
+// return the key of the record held in a page
+func (st *Store) key(b []byte) ([]byte, error) {
+	doc, err := st.unframe(b)
+	if err != nil {
+		return nil, err
+	}
+	if st.codec == nil {
+		return getkey(doc)
+	}
+	k, _, err := unpack(doc)
+	return k, err
+}
+
 // store.go -- decode doc into a pointer supplied by the user
 func decode(b []byte, v interface{}) error {
 	if reflect.ValueOf(v).Kind() != reflect.Ptr {
@@ -127,6 +554,22 @@ func decode(b []byte, v interface{}) error {
 	return nil
 }
 
+// store.go -- return the key of an encoded document
+func getkey(b []byte) ([]byte, error) {
+	var doc []json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc) < 1 {
+		return nil, ErrNotFound
+	}
+	var k string
+	if err := json.Unmarshal(doc[0], &k); err != nil {
+		return nil, err
+	}
+	return []byte(k), nil
+}
+
 // bpt.go, file.go -- return document value from page
 func getdoc(b []byte, klen int) []byte {
 	for i, j, set := klen+4, len(b)-1, 1; i < j; i, j = i+1, j-1 {
@@ -0,0 +1,15 @@
+package idx
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// flush file data (but not unneeded metadata) to disk
+func fdatasync(f *os.File) error {
+	if err := syscall.Fdatasync(int(f.Fd())); err != nil {
+		return fmt.Errorf("fdatasync %s: %w", f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package idx
+
+import "os"
+
+// flush file data to disk; fdatasync is linux only
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
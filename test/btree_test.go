@@ -36,7 +36,7 @@ func TestSet(t *testing.T) {
 	fmt.Println("Ran")
 	for i := 0; i < COUNT; i++ {
 		k := fmt.Sprintf("key-%.5d", i)
-		tree.Set([]byte(k), i)
+		tree.Set([]byte(k), idx.Itob(int64(i)))
 	}
 	if tree.Count() != COUNT {
 		t.Errorf("tree.Count() != %d, it was %d", COUNT, tree.Count())
@@ -48,8 +48,8 @@ func TestGet(t *testing.T) {
 		k := fmt.Sprintf("key-%.5d", i)
 		r := tree.Get([]byte(k))
 		if r != nil {
-			if r.Val != i {
-				t.Errorf("record val != %d, it was %d\n", i, r.Val)
+			if idx.Btoi(r.Val) != int64(i) {
+				t.Errorf("record val != %d, it was %d\n", i, idx.Btoi(r.Val))
 			}
 		} else {
 			t.Errorf("record is nil, key is %s\n", k)
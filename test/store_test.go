@@ -0,0 +1,1265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cagnosolutions/idx"
+	"github.com/cagnosolutions/idx/q"
+)
+
+func openStore(tb testing.TB, opts *idx.Options) (*idx.Store, string) {
+	path := filepath.Join(tb.TempDir(), "store")
+	st, err := idx.OpenStore(path, opts)
+	if err != nil {
+		tb.Fatalf("idx.OpenStore(%q) failed: %v", path, err)
+	}
+	return st, path
+}
+
+func benchmarkDurability(b *testing.B, d idx.Durability) {
+	st, _ := openStore(b, &idx.Options{Durability: d})
+	defer st.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := []byte(fmt.Sprintf("key-%.5d", i%4096))
+		if err := st.Set(k, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_DurabilityNone(b *testing.B) {
+	benchmarkDurability(b, idx.DurabilityNone)
+}
+
+func Benchmark_DurabilityPeriodic(b *testing.B) {
+	benchmarkDurability(b, idx.DurabilityPeriodic)
+}
+
+func Benchmark_DurabilitySync(b *testing.B) {
+	benchmarkDurability(b, idx.DurabilitySync)
+}
+
+func TestReadOnly(t *testing.T) {
+	if _, err := idx.OpenReadOnly(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("idx.OpenReadOnly() created a missing store")
+	}
+	st, path := openStore(t, nil)
+	if err := st.Set([]byte("key"), "val"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := idx.OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := ro.Set([]byte("key"), "new"); err != idx.ErrReadOnly {
+		t.Errorf("ro.Set() = %v, want %v", err, idx.ErrReadOnly)
+	}
+	if err := ro.Del([]byte("key")); err != idx.ErrReadOnly {
+		t.Errorf("ro.Del() = %v, want %v", err, idx.ErrReadOnly)
+	}
+	var v []interface{}
+	if err := ro.Get([]byte("key"), &v); err != nil {
+		t.Errorf("ro.Get() = %v", err)
+	}
+}
+
+func TestLocked(t *testing.T) {
+	st, path := openStore(t, nil)
+	defer st.Close()
+	if _, err := idx.OpenStore(path, &idx.Options{LockTimeout: 50 * time.Millisecond}); !errors.Is(err, idx.ErrLocked) {
+		t.Errorf("idx.OpenStore() = %v, want %v", err, idx.ErrLocked)
+	}
+	if _, err := idx.OpenReadOnly(path); !errors.Is(err, idx.ErrLocked) {
+		t.Errorf("idx.OpenReadOnly() = %v, want %v", err, idx.ErrLocked)
+	}
+}
+
+func TestEngines(t *testing.T) {
+	dir := t.TempDir()
+	mapped, err := idx.OpenMappedData(filepath.Join(dir, "mapped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := idx.OpenFileData(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, engine := range map[string]idx.Engine{
+		"mapped": mapped,
+		"file":   file,
+		"mem":    idx.NewMemData(),
+	} {
+		// pages anywhere in range can be written, even past the end
+		// of the file, and none outside it
+		page := []byte("far out")
+		if err := engine.Set(5000, page); err != nil {
+			t.Errorf("%s: engine.Set(5000) = %v", name, err)
+		} else if b, err := engine.Get(5000); err != nil || !bytes.HasPrefix(b, page) {
+			t.Errorf("%s: engine.Get(5000) = %q, %v", name, b, err)
+		}
+		for _, n := range []int{-1, idx.MAXPAGES} {
+			if err := engine.Set(n, page); err != idx.ErrStoreFull {
+				t.Errorf("%s: engine.Set(%d) = %v, want %v", name, n, err, idx.ErrStoreFull)
+			}
+		}
+		if err := engine.Del(5000); err != nil {
+			t.Fatalf("%s: engine.Del(5000) = %v", name, err)
+		}
+		st, err := idx.NewStoreWith(engine, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := 0; i < COUNT; i++ {
+			if err := st.Set([]byte(fmt.Sprintf("key-%.5d", i)), i); err != nil {
+				t.Fatalf("%s: st.Set() = %v", name, err)
+			}
+		}
+		for i := 0; i < COUNT; i++ {
+			var v []interface{}
+			if err := st.Get([]byte(fmt.Sprintf("key-%.5d", i)), &v); err != nil {
+				t.Fatalf("%s: st.Get() = %v", name, err)
+			}
+			if v[1] != float64(i) {
+				t.Errorf("%s: record val != %d, it was %v", name, i, v[1])
+			}
+		}
+		if err := st.Close(); err != nil {
+			t.Errorf("%s: st.Close() = %v", name, err)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	st, _ := openStore(t, nil)
+	defer st.Close()
+	for i := 0; i < COUNT; i++ {
+		if err := st.Set([]byte(fmt.Sprintf("key-%.5d", i)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := st.Backup(&buf); err != nil {
+		t.Fatalf("st.Backup() = %v", err)
+	}
+	backup := buf.Bytes()
+	if err := st.Set([]byte("key-00000"), "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte(nil), backup...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if err := st.Restore(bytes.NewReader(corrupt)); !errors.Is(err, idx.ErrBadBackup) {
+		t.Errorf("st.Restore(corrupt) = %v, want %v", err, idx.ErrBadBackup)
+	}
+	// a restore is a write like any other as far as snapshots go
+	if err := st.Update(func(tx *idx.Tx) error {
+		if err := st.Restore(bytes.NewReader(backup)); err != nil {
+			t.Fatalf("st.Restore() = %v", err)
+		}
+		var v []interface{}
+		if err := tx.Get([]byte("key-00000"), &v); err != nil || v[1] != "changed" {
+			t.Errorf("tx.Get() during restore = %v, %v", v, err)
+		}
+		return tx.Set([]byte("key-00000"), "lost")
+	}); err != idx.ErrConflict {
+		t.Errorf("st.Update() = %v, want %v", err, idx.ErrConflict)
+	}
+	var v []interface{}
+	if err := st.Get([]byte("key-00000"), &v); err != nil || v[1] != float64(0) {
+		t.Errorf("st.Get() after restore = %v, %v", v, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	st, path := openStore(t, &idx.Options{Compression: idx.CompressFlate})
+	doc := strings.Repeat("all work and no play makes jack a dull boy. ", 200)
+	for i := 0; i < 100; i++ {
+		if err := st.Set([]byte(fmt.Sprintf("key-%.5d", i)), doc); err != nil {
+			t.Fatalf("st.Set() = %v", err)
+		}
+	}
+	stats, err := st.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Records != 100 || stats.CompressionRatio() < 4 {
+		t.Errorf("st.Stats() = %+v, ratio %.2f", stats, stats.CompressionRatio())
+	}
+	st.Close()
+
+	// compression is recorded per record, so reopening without it still reads them
+	st, err = idx.OpenStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var v []interface{}
+	if err := st.Get([]byte("key-00042"), &v); err != nil || v[1] != doc {
+		t.Errorf("st.Get() = %v", err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	keys := &idx.StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{0x2a}, 32)}}
+	// look at the journal while a batch is being applied
+	path := filepath.Join(t.TempDir(), "store")
+	var wal []byte
+	peek := idx.ExtractFunc(func(doc interface{}) []interface{} {
+		if b, err := os.ReadFile(path + ".wal"); err == nil && len(b) > 0 {
+			wal = b
+		}
+		return nil
+	})
+	st, err := idx.OpenStore(path, &idx.Options{Keys: keys, Indexes: map[string]idx.Extractor{"peek": peek}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Batch(func(b *idx.Batch) error {
+		b.Put([]byte("jane@example.com"), "top secret")
+		return b.Put([]byte("john@example.com"), "top secret")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if wal == nil {
+		t.Fatal("journal was never written")
+	}
+	var backup bytes.Buffer
+	if err := st.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	data, err := os.ReadFile(path + ".dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{data, wal, backup.Bytes()} {
+		if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("jane")) {
+			t.Fatal("plaintext found at rest")
+		}
+	}
+	if _, err := idx.OpenStore(path, nil); !errors.Is(err, idx.ErrNoKey) {
+		t.Errorf("idx.OpenStore() without keys = %v, want %v", err, idx.ErrNoKey)
+	}
+
+	// rotate to a new key and rewrite the existing record with it
+	keys.Keys[2], keys.Current = bytes.Repeat([]byte{0x2b}, 32), 2
+	st, err = idx.OpenStore(path, &idx.Options{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	delete(keys.Keys, 1)
+	var v []interface{}
+	if err := st.Get([]byte("jane@example.com"), &v); err != nil || v[1] != "top secret" {
+		t.Errorf("st.Get() = %v, %v", v, err)
+	}
+}
+
+func TestCrashRecover(t *testing.T) {
+	// copy the store as it is part way through applying a batch, with
+	// the page for its last record taken but not yet written
+	path := filepath.Join(t.TempDir(), "store")
+	crashed := filepath.Join(t.TempDir(), "store")
+	var cerr error
+	peek := idx.ExtractFunc(func(doc interface{}) []interface{} {
+		if doc != float64(3) || cerr != nil {
+			return nil
+		}
+		for _, ext := range []string{".dat", ".wal"} {
+			b, err := os.ReadFile(path + ext)
+			if err == nil && ext == ".dat" {
+				b[0] |= 1 << 2 // page 2
+			}
+			if err == nil {
+				err = os.WriteFile(crashed+ext, b, 0644)
+			}
+			if err != nil {
+				cerr = err
+			}
+		}
+		return nil
+	})
+	opts := &idx.Options{Codec: idx.JSONCodec}
+	st, err := idx.OpenStore(path, &idx.Options{Codec: idx.JSONCodec, Indexes: map[string]idx.Extractor{"peek": peek}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set([]byte("a"), 1)
+	if err := st.Batch(func(b *idx.Batch) error {
+		b.Put([]byte("b"), 2)
+		return b.Put([]byte("c"), 3)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	// the batch is rolled forward over the blank page
+	st, err = idx.OpenStore(crashed, opts)
+	if err != nil {
+		t.Fatalf("reopening after a crash = %v", err)
+	}
+	defer st.Close()
+	for i, k := range []string{"a", "b", "c"} {
+		var v int
+		if err := st.Get([]byte(k), &v); err != nil || v != i+1 {
+			t.Errorf("st.Get(%s) = %d, %v, want %d", k, v, err, i+1)
+		}
+	}
+	if stats, err := st.Stats(); err != nil || stats.Records != 3 {
+		t.Errorf("st.Stats() = %+v, %v, want 3 records", stats, err)
+	}
+}
+
+func TestResidency(t *testing.T) {
+	st, _ := openStore(t, nil)
+	defer st.Close()
+	for i := 0; i < COUNT; i++ {
+		if err := st.Set([]byte(fmt.Sprintf("key-%.5d", i)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := st.Residency()
+	if err != nil {
+		t.Fatalf("st.Residency() = %v", err)
+	}
+	if r.Pages == 0 || r.Resident == 0 || r.Fraction() > 1 {
+		t.Errorf("st.Residency() = %+v", r)
+	}
+	mem, err := idx.NewStoreWith(idx.NewMemData(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Residency(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("mem.Residency() = %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestDelReopen(t *testing.T) {
+	st, path := openStore(t, nil)
+	for i := 0; i < COUNT; i++ {
+		if err := st.Set([]byte(fmt.Sprintf("key-%.5d", i)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < COUNT; i += 2 {
+		if err := st.Del([]byte(fmt.Sprintf("key-%.5d", i))); err != nil {
+			t.Fatalf("st.Del() = %v", err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := idx.OpenStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	stats, err := st.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Records != COUNT/2 {
+		t.Errorf("reopened store has %d records, want %d", stats.Records, COUNT/2)
+	}
+	for i := 0; i < COUNT; i++ {
+		var v []interface{}
+		err := st.Get([]byte(fmt.Sprintf("key-%.5d", i)), &v)
+		if i%2 == 0 && err != idx.ErrNotFound {
+			t.Errorf("deleted key-%.5d came back after reopen: %v", i, err)
+		}
+		if i%2 == 1 && err != nil {
+			t.Errorf("key-%.5d missing after reopen: %v", i, err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	st, path := openStore(t, nil)
+	if err := st.Set([]byte("gone"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Batch(func(b *idx.Batch) error {
+		for i := 0; i < 500; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%.5d", i)), i); err != nil {
+				return err
+			}
+		}
+		b.Delete([]byte("gone"))
+		return nil
+	}); err != nil {
+		t.Fatalf("st.Batch() = %v", err)
+	}
+	failed := errors.New("failed")
+	if err := st.Batch(func(b *idx.Batch) error {
+		b.Put([]byte("key-00000"), "never written")
+		return failed
+	}); err != failed {
+		t.Errorf("st.Batch() = %v, want %v", err, failed)
+	}
+	st.Close()
+
+	st, err := idx.OpenStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var v []interface{}
+	if err := st.Get([]byte("gone"), &v); err != idx.ErrNotFound {
+		t.Errorf("st.Get(gone) = %v, want %v", err, idx.ErrNotFound)
+	}
+	if err := st.Get([]byte("key-00000"), &v); err != nil || v[1] != float64(0) {
+		t.Errorf("st.Get(key-00000) = %v, %v", v, err)
+	}
+	if stats, _ := st.Stats(); stats.Records != 500 {
+		t.Errorf("store has %d records, want 500", stats.Records)
+	}
+}
+
+func TestTx(t *testing.T) {
+	st, _ := openStore(t, nil)
+	defer st.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := st.Set([]byte(k), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// move 5 from a to b, reading our own writes along the way
+	if err := st.Update(func(tx *idx.Tx) error {
+		var a, b []interface{}
+		if err := tx.Get([]byte("a"), &a); err != nil {
+			return err
+		}
+		if err := tx.Get([]byte("b"), &b); err != nil {
+			return err
+		}
+		tx.Set([]byte("a"), a[1].(float64)-5)
+		tx.Set([]byte("b"), b[1].(float64)+5)
+		tx.Set([]byte("d"), 0)
+		tx.Del([]byte("c"))
+		if err := tx.Get([]byte("a"), &a); err != nil || a[1] != float64(5) {
+			t.Errorf("tx.Get(a) = %v, %v; want own write", a, err)
+		}
+		var keys []string
+		c := tx.Cursor()
+		for k := c.First(); k != nil; k = c.Next() {
+			keys = append(keys, string(k))
+		}
+		if got := strings.Join(keys, ","); got != "a,b,d" {
+			t.Errorf("cursor saw %q, want %q", got, "a,b,d")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("st.Update() = %v", err)
+	}
+	// errors and panics leave the store untouched
+	failed := errors.New("failed")
+	if err := st.Update(func(tx *idx.Tx) error {
+		tx.Set([]byte("a"), 100)
+		return failed
+	}); err != failed {
+		t.Errorf("st.Update() = %v, want %v", err, failed)
+	}
+	func() {
+		defer func() { recover() }()
+		st.Update(func(tx *idx.Tx) error {
+			tx.Set([]byte("a"), 100)
+			panic("boom")
+		})
+	}()
+	if err := st.View(func(tx *idx.Tx) error {
+		var v []interface{}
+		if err := tx.Get([]byte("a"), &v); err != nil || v[1] != float64(5) {
+			t.Errorf("tx.Get(a) = %v, %v; want 5", v, err)
+		}
+		if err := tx.Get([]byte("c"), &v); err != idx.ErrNotFound {
+			t.Errorf("tx.Get(c) = %v, want %v", err, idx.ErrNotFound)
+		}
+		if err := tx.Set([]byte("a"), 1); err != idx.ErrTxRead {
+			t.Errorf("tx.Set() = %v, want %v", err, idx.ErrTxRead)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("st.View() = %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	st, _ := openStore(t, nil)
+	defer st.Close()
+	st.Set([]byte("a"), 1)
+	st.Set([]byte("b"), 1)
+	if err := st.View(func(tx *idx.Tx) error {
+		// writers aren't held up by the view, nor seen by it
+		st.Set([]byte("a"), 2)
+		st.Del([]byte("b"))
+		st.Set([]byte("c"), 2)
+		var v []interface{}
+		if err := tx.Get([]byte("a"), &v); err != nil || v[1] != float64(1) {
+			t.Errorf("tx.Get(a) = %v, %v; want 1", v, err)
+		}
+		if err := tx.Get([]byte("c"), &v); err != idx.ErrNotFound {
+			t.Errorf("tx.Get(c) = %v, want %v", err, idx.ErrNotFound)
+		}
+		var keys []string
+		c := tx.Cursor()
+		for k := c.First(); k != nil; k = c.Next() {
+			keys = append(keys, string(k))
+		}
+		if got := strings.Join(keys, ","); got != "a,b" {
+			t.Errorf("cursor saw %q, want %q", got, "a,b")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := st.GC(); n != 3 {
+		t.Errorf("st.GC() reclaimed %d versions, want 3", n)
+	}
+	// the first of two conflicting writers wins
+	if err := st.Update(func(tx *idx.Tx) error {
+		st.Set([]byte("a"), 3)
+		return tx.Set([]byte("a"), 4)
+	}); err != idx.ErrConflict {
+		t.Errorf("st.Update() = %v, want %v", err, idx.ErrConflict)
+	}
+	var v []interface{}
+	if err := st.Get([]byte("a"), &v); err != nil || v[1] != float64(3) {
+		t.Errorf("st.Get(a) = %v, %v; want 3", v, err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	type user struct {
+		Name    string
+		Age     int64
+		Tags    []string
+		Created time.Time
+	}
+	want := user{"scott", 1 << 60, []string{"a", "b"}, time.Unix(1700000000, 0).UTC()}
+	for _, c := range []idx.Codec{idx.JSONCodec, idx.GobCodec, idx.BinaryCodec} {
+		st, path := openStore(t, &idx.Options{Codec: c})
+		if err := st.Set([]byte("user"), want); err != nil {
+			t.Fatalf("codec %d: st.Set() = %v", c.ID(), err)
+		}
+		st.Close()
+		// reopens with the codec recorded in the header
+		st, err := idx.OpenStore(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got user
+		if err := st.Get([]byte("user"), &got); err != nil {
+			t.Errorf("codec %d: st.Get() = %v", c.ID(), err)
+		} else if got.Name != want.Name || got.Age != want.Age || len(got.Tags) != 2 || !got.Created.Equal(want.Created) {
+			t.Errorf("codec %d: st.Get() = %+v, want %+v", c.ID(), got, want)
+		}
+		st.Close()
+		if _, err := idx.OpenStore(path, &idx.Options{Codec: idx.RawCodec}); !errors.Is(err, idx.ErrCodec) {
+			t.Errorf("codec %d: reopening with another codec = %v, want %v", c.ID(), err, idx.ErrCodec)
+		}
+	}
+
+	st, _ := openStore(t, &idx.Options{Codec: idx.BinaryCodec})
+	defer st.Close()
+	st.Set([]byte("n"), map[string]interface{}{"n": int64(-42), "b": []byte{1, 2}})
+	var v map[string]interface{}
+	if err := st.Get([]byte("n"), &v); err != nil || v["n"] != int64(-42) || !bytes.Equal(v["b"].([]byte), []byte{1, 2}) {
+		t.Errorf("st.Get() = %#v, %v", v, err)
+	}
+
+	raw, _ := openStore(t, &idx.Options{Codec: idx.RawCodec})
+	defer raw.Close()
+	raw.Set([]byte("k"), []byte("plain"))
+	var b []byte
+	if err := raw.Get([]byte("k"), &b); err != nil || string(b) != "plain" {
+		t.Errorf("raw.Get() = %q, %v", b, err)
+	}
+	// values are there to be listed, but not looked into
+	var all [][]byte
+	if err := raw.Find(nil, &all); err != nil || len(all) != 1 || string(all[0]) != "plain" {
+		t.Errorf("raw.Find(nil) = %q, %v", all, err)
+	}
+	if err := raw.Find(q.Eq("n", 1), &all); !errors.Is(err, idx.ErrNotDocument) {
+		t.Errorf("raw.Find(n = 1) = %v, want %v", err, idx.ErrNotDocument)
+	}
+	if rows, err := raw.Aggregate(nil, nil, q.Count()); err != nil || rows[0]["count"] != 1 {
+		t.Errorf("raw.Aggregate(count) = %v, %v", rows, err)
+	}
+	if err := raw.CreateIndex("n", idx.Path("n")); !errors.Is(err, idx.ErrNotDocument) {
+		t.Errorf("raw.CreateIndex() = %v, want %v", err, idx.ErrNotDocument)
+	}
+}
+
+func TestTypedStore(t *testing.T) {
+	type order struct {
+		Customer string
+		Total    int64
+	}
+	for _, c := range []idx.Codec{nil, idx.BinaryCodec} {
+		st, _ := openStore(t, &idx.Options{Codec: c})
+		orders := idx.NewTypedStore[order](st)
+		for i := 0; i < 10; i++ {
+			if err := orders.Put([]byte(fmt.Sprintf("order-%d", i)), order{"acme", int64(i) * 100}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if o, err := orders.Get([]byte("order-3")); err != nil || o.Total != 300 {
+			t.Errorf("orders.Get() = %+v, %v", o, err)
+		}
+		if _, err := orders.Get([]byte("order-x")); err != idx.ErrNotFound {
+			t.Errorf("orders.Get(missing) = %v, want %v", err, idx.ErrNotFound)
+		}
+		var n, total int64
+		if err := orders.Scan(func(k []byte, o order) bool {
+			n++
+			total += o.Total
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 10 || total != 4500 {
+			t.Errorf("scanned %d orders totalling %d, want 10 totalling 4500", n, total)
+		}
+		st.Close()
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	type user struct {
+		Email string   `json:"email"`
+		Tags  []string `json:"tags"`
+	}
+	st, path := openStore(t, &idx.Options{Codec: idx.JSONCodec})
+	st.Set([]byte("u1"), user{"a@x.com", []string{"admin", "staff"}})
+	st.Set([]byte("u2"), user{"b@x.com", []string{"staff"}})
+	if err := st.CreateIndex("email", idx.Path("email")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CreateIndex("tags", idx.Path("$.tags")); err != nil {
+		t.Fatal(err)
+	}
+	st.Set([]byte("u3"), user{"c@x.com", nil})
+	var u user
+	if err := st.GetBy("email", "c@x.com", &u); err != nil || u.Email != "c@x.com" {
+		t.Errorf("st.GetBy(c@x.com) = %+v, %v", u, err)
+	}
+	if keys, err := st.KeysBy("tags", "staff"); err != nil || len(keys) != 2 || string(keys[0]) != "u1" {
+		t.Errorf("st.KeysBy(staff) = %q, %v", keys, err)
+	}
+	// updates and deletes keep the index in step
+	st.Set([]byte("u1"), user{"z@x.com", nil})
+	st.Del([]byte("u2"))
+	for _, email := range []string{"a@x.com", "b@x.com"} {
+		if err := st.GetBy("email", email, &u); err != idx.ErrNotFound {
+			t.Errorf("st.GetBy(%s) = %v, want %v", email, err, idx.ErrNotFound)
+		}
+	}
+	if _, err := st.KeysBy("nope", "x"); !errors.Is(err, idx.ErrNoIndex) {
+		t.Errorf("st.KeysBy(nope) = %v, want %v", err, idx.ErrNoIndex)
+	}
+	st.Close()
+
+	st, err := idx.OpenStore(path, &idx.Options{Indexes: map[string]idx.Extractor{
+		"email": idx.Path("email"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.GetBy("email", "z@x.com", &u); err != nil || u.Email != "z@x.com" {
+		t.Errorf("after reopening, st.GetBy(z@x.com) = %+v, %v", u, err)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	st, _ := openStore(t, &idx.Options{Codec: idx.JSONCodec})
+	defer st.Close()
+	st.Set([]byte("u1"), map[string]string{"email": "a@x.com", "team": "red"})
+	st.Set([]byte("u2"), map[string]string{"email": "b@x.com", "team": "red"})
+	var uv *idx.ErrUniqueViolation
+	if err := st.CreateUniqueIndex("team", idx.Path("team")); !errors.As(err, &uv) || uv.Value != "red" {
+		t.Errorf("st.CreateUniqueIndex(team) = %v, want a violation", err)
+	}
+	if err := st.CreateUniqueIndex("email", idx.Path("email")); err != nil {
+		t.Fatal(err)
+	}
+	// rewriting a record with its own value is fine
+	if err := st.Set([]byte("u1"), map[string]string{"email": "a@x.com"}); err != nil {
+		t.Errorf("st.Set(u1) = %v", err)
+	}
+	err := st.Add([]byte("u3"), map[string]string{"email": "b@x.com"})
+	if !errors.As(err, &uv) || uv.Index != "email" || uv.Value != "b@x.com" {
+		t.Errorf("st.Add(u3) = %v, want a violation of email", err)
+	}
+	// a batch that breaks the constraint writes nothing
+	err = st.Batch(func(b *idx.Batch) error {
+		b.Put([]byte("u4"), map[string]string{"email": "d@x.com"})
+		b.Put([]byte("u5"), map[string]string{"email": "d@x.com"})
+		return nil
+	})
+	if !errors.As(err, &uv) {
+		t.Errorf("st.Batch() = %v, want a violation", err)
+	}
+	var v map[string]string
+	for _, k := range []string{"u3", "u4", "u5"} {
+		if err := st.Get([]byte(k), &v); err != idx.ErrNotFound {
+			t.Errorf("st.Get(%s) = %v, want %v", k, err, idx.ErrNotFound)
+		}
+	}
+	if err := st.GetBy("email", "d@x.com", &v); err != idx.ErrNotFound {
+		t.Errorf("st.GetBy(d@x.com) = %v, want %v", err, idx.ErrNotFound)
+	}
+	// nor does it conflict with transactions
+	if err := st.Update(func(tx *idx.Tx) error {
+		st.Add([]byte("u3"), map[string]string{"email": "b@x.com"})
+		return tx.Set([]byte("u3"), map[string]string{"email": "c@x.com"})
+	}); err != nil {
+		t.Errorf("st.Update() = %v", err)
+	}
+}
+
+func TestUniqueJournal(t *testing.T) {
+	// copy the store as it is at the moment the extractor sees e@x.com,
+	// as if it went down then
+	path := filepath.Join(t.TempDir(), "store")
+	crashed := filepath.Join(t.TempDir(), "store")
+	var cerr error
+	email := idx.ExtractFunc(func(doc interface{}) []interface{} {
+		if m, ok := doc.(map[string]interface{}); ok && m["email"] == "e@x.com" {
+			for _, ext := range []string{".dat", ".wal"} {
+				b, err := os.ReadFile(path + ext)
+				if err == nil {
+					err = os.WriteFile(crashed+ext, b, 0644)
+				}
+				if err != nil && cerr == nil {
+					cerr = err
+				}
+			}
+		}
+		return idx.Path("email").Extract(doc)
+	})
+	opts := &idx.Options{Codec: idx.JSONCodec, UniqueIndexes: map[string]idx.Extractor{"email": email}}
+	st, err := idx.OpenStore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set([]byte("u1"), map[string]string{"email": "a@x.com"})
+	// a batch that breaks the constraint is turned down before it is
+	// journaled, so it isn't rolled forward when the store reopens
+	var uv *idx.ErrUniqueViolation
+	err = st.Batch(func(b *idx.Batch) error {
+		b.Put([]byte("u2"), map[string]string{"email": "e@x.com"})
+		b.Put([]byte("u3"), map[string]string{"email": "a@x.com"})
+		return nil
+	})
+	if !errors.As(err, &uv) {
+		t.Errorf("st.Batch() = %v, want a violation", err)
+	}
+	// while one that frees a value before taking it is fine
+	if err := st.Batch(func(b *idx.Batch) error {
+		b.Delete([]byte("u1"))
+		b.Put([]byte("u4"), map[string]string{"email": "a@x.com"})
+		return nil
+	}); err != nil {
+		t.Errorf("st.Batch() = %v", err)
+	}
+	st.Close()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	st, err = idx.OpenStore(crashed, opts)
+	if err != nil {
+		t.Fatalf("reopening after a crash = %v", err)
+	}
+	defer st.Close()
+	var v map[string]string
+	if err := st.Get([]byte("u1"), &v); err != nil || v["email"] != "a@x.com" {
+		t.Errorf("st.Get(u1) = %v, %v", v, err)
+	}
+	if err := st.Get([]byte("u2"), &v); err != idx.ErrNotFound {
+		t.Errorf("st.Get(u2) = %v, want %v", err, idx.ErrNotFound)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	type user struct {
+		Name   string `json:"name"`
+		Age    int    `json:"age"`
+		Status string `json:"status"`
+		City   string `json:"city"`
+	}
+	st, _ := openStore(t, &idx.Options{Codec: idx.JSONCodec})
+	defer st.Close()
+	users := []user{
+		{"ann", 25, "active", "leeds"},
+		{"bob", 31, "active", "york"},
+		{"cat", 42, "banned", "york"},
+		{"dan", 29, "active", "hull"},
+		{"eve", 35, "active", "leeds"},
+	}
+	for i, u := range users {
+		st.Set([]byte(fmt.Sprintf("user-%d", i)), u)
+	}
+	st.CreateIndex("age", idx.Path("age"))
+
+	names := func(us []user) string {
+		var s []string
+		for _, u := range us {
+			s = append(s, u.Name)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, tt := range []struct{ query, want string }{
+		{"SELECT * FROM users", "ann,bob,cat,dan,eve"},
+		{"select * from users where status = 'active' and age > 28", "bob,dan,eve"},
+		{"SELECT * FROM users WHERE age >= 31 AND age < 42", "bob,eve"},
+		{"SELECT * FROM users WHERE age <= 29", "ann,dan"},
+		{"SELECT * FROM users WHERE city IN ('york', 'hull') ORDER BY age DESC", "cat,bob,dan"},
+		{"SELECT * FROM users WHERE name LIKE 'e%' OR age = 25", "ann,eve"},
+		{"SELECT * FROM users WHERE status != active ORDER BY name", "cat"},
+		{"SELECT * FROM users WHERE (city = 'leeds' OR city = 'york') AND age > 30 ORDER BY age LIMIT 2", "bob,eve"},
+		{"SELECT * FROM users ORDER BY age LIMIT 2 OFFSET 1", "dan,bob"},
+		{"SELECT * FROM users LIMIT 2 OFFSET 3", "dan,eve"},
+		{"SELECT * FROM users WHERE _key > 'user-2' AND _key PREFIX 'user-'", "dan,eve"},
+		{"select * from users where name=cat, age>28", "cat"},
+	} {
+		var got []user
+		if err := st.Query(tt.query, &got); err != nil {
+			t.Errorf("st.Query(%q) = %v", tt.query, err)
+		} else if names(got) != tt.want {
+			t.Errorf("st.Query(%q) = %s, want %s", tt.query, names(got), tt.want)
+		}
+	}
+
+	var rows []map[string]interface{}
+	if err := st.Query("SELECT name, city FROM users WHERE age = 42", &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["name"] != "cat" || rows[0]["city"] != "york" || len(rows[0]) != 2 {
+		t.Errorf("projected rows = %v", rows)
+	}
+	for _, bad := range []string{"SELECT FROM users", "SELECT * FROM users WHERE", "SELECT * FROM users WHERE age ~ 1", "SELECT * FROM users LIMIT x"} {
+		if err := st.Query(bad, &rows); !errors.Is(err, idx.ErrBadQuery) {
+			t.Errorf("st.Query(%q) = %v, want %v", bad, err, idx.ErrBadQuery)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	type user struct {
+		Name    string             `json:"name"`
+		Age     float64            `json:"age"`
+		Status  string             `json:"status"`
+		Address map[string]string  `json:"address"`
+		Scores  map[string]float64 `json:"scores"`
+	}
+	st, _ := openStore(t, &idx.Options{Codec: idx.JSONCodec})
+	defer st.Close()
+	users := []user{
+		{"ann", 25, "active", map[string]string{"city": "leeds"}, map[string]float64{"go": 9}},
+		{"bob", 31.5, "active", map[string]string{"city": "york"}, map[string]float64{"go": 7.5}},
+		{"cat", 42, "banned", map[string]string{"city": "york"}, nil},
+		{"dan", 28, "active", map[string]string{"city": "hull"}, map[string]float64{"go": 10}},
+	}
+	for i, u := range users {
+		st.Set([]byte(fmt.Sprintf("user-%d", i)), u)
+	}
+
+	names := func(us []user) string {
+		var s []string
+		for _, u := range us {
+			s = append(s, u.Name)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, tt := range []struct {
+		filter idx.Filter
+		want   string
+	}{
+		{q.And(q.Eq("status", "active"), q.Gt("age", 28)), "bob"},
+		{q.Gte("age", uint8(28)), "bob,cat,dan"},
+		{q.Lt("age", 31.5), "ann,dan"},
+		{q.Ne("status", "active"), "cat"},
+		{q.Eq("address.city", "york"), "bob,cat"},
+		{q.Gt("scores.go", 8), "ann,dan"},
+		{q.Ne("scores.go", 10), "ann,bob,cat"},
+		{q.Or(q.Prefix("name", "d"), q.In("address.city", "leeds")), "ann,dan"},
+		{q.Gt("name", "bob"), "cat,dan"},
+		{q.Eq("age", "25"), ""},
+		{q.Not(q.Eq("status", "active")), "cat"},
+		{q.Key(idx.OpGte, "user-2"), "cat,dan"},
+	} {
+		var got []user
+		if err := st.Find(tt.filter, &got); err != nil {
+			t.Errorf("st.Find(%v) = %v", tt.filter, err)
+		} else if names(got) != tt.want {
+			t.Errorf("st.Find(%v) = %s, want %s", tt.filter, names(got), tt.want)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	st, _ := openStore(t, &idx.Options{Codec: idx.JSONCodec})
+	defer st.Close()
+	for i, u := range []map[string]interface{}{
+		{"name": "ann", "age": 25, "city": "leeds", "status": "active"},
+		{"name": "bob", "age": 31, "city": "york", "status": "active"},
+		{"name": "cat", "age": 42, "city": "york", "status": "banned"},
+		{"name": "dan", "age": 29, "city": "hull", "status": "active"},
+		{"name": "eve", "age": 35, "city": "leeds", "status": "active"},
+		{"name": "fay", "city": "york", "status": "active"},
+	} {
+		st.Set([]byte(fmt.Sprintf("user-%d", i)), u)
+	}
+	st.CreateIndex("status", idx.Path("status"))
+
+	rows, err := st.Aggregate(nil, nil, q.Count())
+	if err != nil || len(rows) != 1 || rows[0]["count"] != 6 {
+		t.Errorf("count = %v, %v", rows, err)
+	}
+	rows, err = st.Aggregate(q.Eq("status", "active"), []string{"city"},
+		q.Count(), q.Sum("age"), q.Avg("age"), q.Min("name"), q.Max("age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"map[avg(age):29 city:hull count:1 max(age):29 min(name):dan sum(age):29]",
+		"map[avg(age):30 city:leeds count:2 max(age):35 min(name):ann sum(age):60]",
+		"map[avg(age):31 city:york count:2 max(age):31 min(name):bob sum(age):31]",
+	}
+	if got := fmt.Sprint(rows); got != "["+strings.Join(want, " ")+"]" {
+		t.Errorf("grouped rows = %s", got)
+	}
+	rows, err = st.Aggregate(q.Gt("age", 100), nil, q.Count(), idx.Agg{Op: idx.AggAvg, Field: "age", Name: "mean"})
+	if err != nil || len(rows) != 1 || rows[0]["count"] != 0 || rows[0]["mean"] != nil {
+		t.Errorf("empty aggregate = %v, %v", rows, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	opts := &idx.Options{Codec: idx.JSONCodec, WatchBuffer: 4, ChangeLog: 8}
+	st, path := openStore(t, opts)
+	defer st.Close()
+	users := st.Watch([]byte("user-"))
+	st.Set([]byte("user-1"), "ann")
+	st.Set([]byte("post-1"), "hello")
+	st.Set([]byte("user-1"), "bob")
+	st.Del([]byte("user-1"))
+
+	want := []struct {
+		seq      uint64
+		op       idx.EventOp
+		old, new string
+	}{{1, idx.EventSet, "", "ann"}, {3, idx.EventSet, "ann", "bob"}, {4, idx.EventDel, "bob", ""}}
+	var base uint64 // sequence numbers carry on from the clock
+	for i, w := range want {
+		e := <-users
+		if i == 0 {
+			base = e.Seq - 1
+		}
+		w.seq += base
+		var old, new string
+		if e.Old != nil {
+			st.Decode(e.Old, &old)
+		}
+		if e.New != nil {
+			st.Decode(e.New, &new)
+		}
+		if e.Seq != w.seq || e.Op != w.op || string(e.Key) != "user-1" || old != w.old || new != w.new {
+			t.Errorf("event = %d %v %s %q %q, want %d %v user-1 %q %q", e.Seq, e.Op, e.Key, old, new, w.seq, w.op, w.old, w.new)
+		}
+	}
+
+	// a subscriber that falls behind is closed, and can resume
+	for i := 0; i < 5; i++ {
+		st.Set([]byte("user-2"), i)
+	}
+	var last uint64
+	for e := range users {
+		last = e.Seq
+	}
+	if last != base+8 {
+		t.Errorf("last event before overflow = %d, want %d", last, base+8)
+	}
+	users, err := st.WatchFrom([]byte("user-"), last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-users; e.Seq != base+9 {
+		t.Errorf("resumed at event %d, want %d", e.Seq, base+9)
+	}
+	st.Unwatch(users)
+	if _, ok := <-users; ok {
+		t.Error("channel still open after Unwatch")
+	}
+	if _, err := st.WatchFrom(nil, 0); !errors.Is(err, idx.ErrSeqGone) {
+		t.Errorf("st.WatchFrom(nil, 0) = %v, want %v", err, idx.ErrSeqGone)
+	}
+
+	// numbers from before the store was reopened are never reused
+	st.Close()
+	st, err = idx.OpenStore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for i := 0; i < 10; i++ {
+		st.Set([]byte("user-3"), i)
+	}
+	if _, err := st.WatchFrom(nil, last); !errors.Is(err, idx.ErrSeqGone) {
+		t.Errorf("st.WatchFrom() after reopening = %v, want %v", err, idx.ErrSeqGone)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	opts := &idx.Options{Codec: idx.JSONCodec, ReapInterval: 10 * time.Millisecond}
+	st, path := openStore(t, opts)
+	st.SetWithTTL([]byte("session"), "abc", 50*time.Millisecond)
+	st.SetWithTTL([]byte("cache"), "def", time.Hour)
+	st.SetWithTTL([]byte("reset"), "ghi", time.Hour)
+	st.Set([]byte("reset"), "jkl")
+	st.Set([]byte("user"), "ann")
+
+	if d, err := st.TTL([]byte("cache")); err != nil || d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("st.TTL(cache) = %v, %v", d, err)
+	}
+	for _, k := range []string{"reset", "user"} {
+		if d, err := st.TTL([]byte(k)); err != nil || d != 0 {
+			t.Errorf("st.TTL(%s) = %v, %v, want 0", k, d, err)
+		}
+	}
+	var s string
+	if err := st.Get([]byte("session"), &s); err != nil || s != "abc" {
+		t.Errorf("st.Get(session) = %q, %v before it expired", s, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := st.Get([]byte("session"), &s); err != idx.ErrNotFound {
+		t.Errorf("st.Get(session) = %v after it expired, want %v", err, idx.ErrNotFound)
+	}
+	if _, err := st.TTL([]byte("session")); err != idx.ErrNotFound {
+		t.Errorf("st.TTL(session) = %v after it expired, want %v", err, idx.ErrNotFound)
+	}
+	if stats, err := st.Stats(); err != nil || stats.Records != 3 {
+		t.Errorf("%d records left after reaping, want 3 (%v)", stats.Records, err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// expiry times are kept with the records
+	st, err := idx.OpenStore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if d, err := st.TTL([]byte("cache")); err != nil || d <= 59*time.Minute {
+		t.Errorf("st.TTL(cache) = %v, %v after reopening", d, err)
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	keys := &idx.StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{0x2a}, 32)}}
+	opts := &idx.Options{Codec: idx.JSONCodec, Keys: keys, Compression: idx.CompressFlate}
+	st, path := openStore(t, opts)
+	k := []byte("counter")
+	if err := st.SetIf(k, 1, 1); err != idx.ErrVersionMismatch {
+		t.Errorf("st.SetIf on a missing key = %v, want %v", err, idx.ErrVersionMismatch)
+	}
+	if err := st.SetIf(k, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	v1, _ := st.GetVersion(k, nil)
+	st.Set(k, 2)
+	var n int
+	v2, err := st.GetVersion(k, &n)
+	if err != nil || v2 <= v1 || n != 2 {
+		t.Errorf("st.GetVersion = %d, %d, %v, want a version above %d of 2", v2, n, err, v1)
+	}
+	if err := st.SetIf(k, 3, v1); err != idx.ErrVersionMismatch {
+		t.Errorf("st.SetIf with a stale version = %v, want %v", err, idx.ErrVersionMismatch)
+	}
+	if err := st.SetIf(k, 3, v2); err != nil {
+		t.Errorf("st.SetIf with the current version = %v", err)
+	}
+	st.Batch(func(b *idx.Batch) error {
+		b.Put(k, 4)
+		return b.Put(k, 5)
+	})
+	v5, err := st.GetVersion(k, nil)
+	if err != nil || v5 <= v2+1 {
+		t.Errorf("st.GetVersion after a batch = %d, %v, want above %d", v5, err, v2+1)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// versions are kept with the records
+	st, err = idx.OpenStore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := st.GetVersion(k, &n); err != nil || v != v5 || n != 5 {
+		t.Errorf("st.GetVersion after reopening = %d, %d, %v, want version %d of 5", v, n, err, v5)
+	}
+	// and never handed out twice, even once the key is deleted
+	st.Del(k)
+	if _, err := st.GetVersion(k, nil); err != idx.ErrNotFound {
+		t.Errorf("st.GetVersion after deleting = %v, want %v", err, idx.ErrNotFound)
+	}
+	st.Close()
+	st, err = idx.OpenStore(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetIf(k, 6, 0); err != nil {
+		t.Errorf("st.SetIf after deleting = %v", err)
+	}
+	if v, err := st.GetVersion(k, nil); err != nil || v <= v5 {
+		t.Errorf("st.GetVersion after adding back = %d, %v, want above %d", v, err, v5)
+	}
+	st.Close()
+
+	// the version is authenticated along with the encrypted document
+	b, err := os.ReadFile(path + ".dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[idx.DATAOFFSET+4+7] ^= 0xff
+	if err := os.WriteFile(path+".dat", b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := idx.OpenStore(path, opts); !errors.Is(err, idx.ErrBadRecord) {
+		t.Errorf("opening with a tampered version = %v, want %v", err, idx.ErrBadRecord)
+		if err == nil {
+			st.Close()
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	st, path := openStore(t, nil)
+	const n = 5000
+	for i := 0; i < n; i++ {
+		st.Set([]byte(fmt.Sprintf("key-%.5d", i)), i)
+	}
+	for i := 0; i < n; i++ {
+		if i%10 != 0 {
+			st.Del([]byte(fmt.Sprintf("key-%.5d", i)))
+		}
+	}
+	size := func() int64 {
+		fi, err := os.Stat(path + ".dat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	before := size()
+	for done := false; !done; {
+		var err error
+		if done, err = st.Compact(100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := size(); after >= before {
+		t.Errorf("data file is %d bytes after compacting, was %d", after, before)
+	}
+	check := func() {
+		for i := 0; i < n; i += 10 {
+			var v []interface{}
+			k := fmt.Sprintf("key-%.5d", i)
+			if err := st.Get([]byte(k), &v); err != nil || len(v) != 2 || v[1] != float64(i) {
+				t.Fatalf("st.Get(%s) = %v, %v", k, v, err)
+			}
+		}
+	}
+	check()
+
+	// a running compactor stops with the store
+	st.Compactor(time.Millisecond, 10)
+	time.Sleep(5 * time.Millisecond)
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := idx.OpenStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	check()
+}
+
+func TestGrow(t *testing.T) {
+	// more records than fit in the initial 16MB mapping
+	st, path := openStore(t, nil)
+	const n = 4500
+	for i := 0; i < n; i++ {
+		if err := st.Set([]byte(fmt.Sprintf("key-%.5d", i)), i); err != nil {
+			t.Fatalf("st.Set(%d) = %v", i, err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := idx.OpenStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for i := 0; i < n; i++ {
+		var v []interface{}
+		k := fmt.Sprintf("key-%.5d", i)
+		if err := st.Get([]byte(k), &v); err != nil || len(v) != 2 || v[1] != float64(i) {
+			t.Fatalf("st.Get(%s) = %v, %v after reopening", k, v, err)
+		}
+	}
+}
+
+func TestClosed(t *testing.T) {
+	st, _ := openStore(t, &idx.Options{Durability: idx.DurabilityPeriodic, SyncInterval: time.Millisecond})
+	st.Set([]byte("k"), "v")
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Errorf("closing again = %v", err)
+	}
+	var v interface{}
+	for name, err := range map[string]error{
+		"Set":   st.Set([]byte("k"), "v"),
+		"Get":   st.Get([]byte("k"), &v),
+		"Del":   st.Del([]byte("k")),
+		"Sync":  st.Sync(),
+		"View":  st.View(func(*idx.Tx) error { return nil }),
+		"Find":  st.Find(nil, &[]interface{}{}),
+		"Batch": st.Batch(func(b *idx.Batch) error { return b.Put([]byte("k"), "v") }),
+	} {
+		if err != idx.ErrClosed {
+			t.Errorf("%s after closing = %v, want %v", name, err, idx.ErrClosed)
+		}
+	}
+	if _, err := st.Compact(10); err != idx.ErrClosed {
+		t.Errorf("Compact after closing = %v, want %v", err, idx.ErrClosed)
+	}
+	if err := st.Compactor(time.Millisecond, 10)(); err != idx.ErrClosed {
+		t.Errorf("Compactor after closing = %v, want %v", err, idx.ErrClosed)
+	}
+}
@@ -0,0 +1,143 @@
+package idx
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// default interval between sweeps for expired records
+const DefaultReapInterval = time.Second
+
+// most expired records deleted by a single sweep, so
+// that writers are never held up for long
+const reapBatch = 1024
+
+// SetWithTTL adds or updates a key value pair that expires once d has
+// passed. The expiry time is stored in the record's header, so it
+// survives the store being closed and reopened. Expired keys can't be
+// read, and their records are deleted in the background; see
+// Options.ReapInterval. A d of zero or less never expires, just like
+// Set, which also clears any expiry a key had.
+func (st *Store) SetWithTTL(k []byte, v interface{}, d time.Duration) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	var m meta
+	if d > 0 {
+		m.expires = time.Now().Add(d).UnixNano()
+	}
+	doc, err := st.pack(k, v)
+	if err != nil {
+		return err
+	}
+	rec, err := st.frame(doc, m)
+	if err != nil {
+		return err
+	}
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return ErrClosed
+	}
+	return st.commit([]*op{{key: k, rec: rec}})
+}
+
+// TTL returns how long is left until a key expires, or 0 if it never
+// does. It fails with ErrNotFound if the key doesn't exist or has
+// already expired.
+func (st *Store) TTL(k []byte) (time.Duration, error) {
+	st.RLock()
+	defer st.RUnlock()
+	if st.closed {
+		return 0, ErrClosed
+	}
+	if !st.index.Has(k) || st.expired(k) {
+		return 0, ErrNotFound
+	}
+	exp, ok := st.ttl[string(k)]
+	if !ok {
+		return 0, nil
+	}
+	return time.Until(time.Unix(0, exp)), nil
+}
+
+// reports whether the record held for k has expired; must hold the lock
+func (st *Store) expired(k []byte) bool {
+	exp, ok := st.ttl[string(k)]
+	return ok && exp <= time.Now().UnixNano()
+}
+
+// reports whether a record has expired, going by its header
+func lapsed(rec []byte) bool {
+	h, err := parseRecord(rec)
+	return err == nil && h.expires != 0 && h.expires <= time.Now().UnixNano()
+}
+
+// keep the expiry index, and the highest version seen, in step with
+// the record now held for k, which is nil once it is deleted; must
+// hold the lock
+func (st *Store) track(k, rec []byte) {
+	if exp, ok := st.ttl[string(k)]; ok {
+		st.expiring.Del(expiryKey(exp, k))
+		delete(st.ttl, string(k))
+	}
+	if rec == nil {
+		return
+	}
+	h, err := parseRecord(rec)
+	if err != nil {
+		return
+	}
+	if h.version > st.vmax {
+		st.vmax = h.version
+	}
+	if h.expires != 0 {
+		k = append([]byte(nil), k...)
+		st.ttl[string(k)] = h.expires
+		st.expiring.Set(expiryKey(h.expires, k), k)
+	}
+}
+
+// expiry index entries are keyed by expiry time, then key
+func expiryKey(exp int64, k []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(exp)), k...)
+}
+
+// delete records that expired by now, oldest first; must hold the lock
+func (st *Store) reap(now time.Time) error {
+	var ops []*op
+	st.expiring.Ascend(nil, func(r *Record) bool {
+		if int64(binary.BigEndian.Uint64(r.Key)) > now.UnixNano() || len(ops) == reapBatch {
+			return false
+		}
+		ops = append(ops, &op{key: append([]byte(nil), r.Val...)})
+		return true
+	})
+	if len(ops) == 0 {
+		return nil
+	}
+	return st.commit(ops)
+}
+
+// deletes expired records in the background until the store is closed
+func (st *Store) reaper() {
+	defer st.wg.Done()
+	t := time.NewTicker(st.opts.ReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-st.done:
+			return
+		case <-t.C:
+			st.Lock()
+			if st.closed {
+				st.Unlock()
+				return
+			}
+			if err := st.reap(time.Now()); err != nil && st.err == nil {
+				st.err = err
+			}
+			st.Unlock()
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package idx
+
+import "bytes"
+
+// Tx is a transaction on a store, started with Store.Update or
+// Store.View. Every read made through a Tx sees the store as it was
+// when the Tx began, along with the Tx's own writes, which are
+// buffered until it commits; they are then applied to the store
+// atomically, in the same way as a Batch.
+type Tx struct {
+	st       *Store
+	ts       uint64 // timestamp of the snapshot being read
+	writable bool
+	writes   map[string]*op // latest pending change per key
+	order    []*op          // pending changes in the order they were made
+	done     bool
+}
+
+// Update runs fn in a read-write transaction. If fn returns nil the
+// transaction's writes are committed atomically; if it returns an
+// error or panics, they are discarded and the store is left as it was.
+//
+// Transactions run under snapshot isolation: the store is not locked
+// while fn runs, so other readers and writers carry on alongside it.
+// If a key written by fn was changed by another commit after the
+// transaction began, nothing is written and Update returns ErrConflict;
+// the caller can then run the transaction again.
+func (st *Store) Update(fn func(tx *Tx) error) error {
+	if st.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	ts, err := st.begin()
+	if err != nil {
+		return err
+	}
+	tx := &Tx{st: st, ts: ts, writable: true, writes: make(map[string]*op)}
+	defer tx.close()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// View runs fn in a read only transaction. It reads from a consistent
+// snapshot of the store without holding the store's lock, so long
+// running views do not hold up writers.
+func (st *Store) View(fn func(tx *Tx) error) error {
+	ts, err := st.begin()
+	if err != nil {
+		return err
+	}
+	tx := &Tx{st: st, ts: ts}
+	defer tx.close()
+	return fn(tx)
+}
+
+// Get decodes the value for a key into ptr, including any
+// change made to it earlier in the transaction.
+func (tx *Tx) Get(k []byte, ptr interface{}) error {
+	rec, err := tx.get(k)
+	if err != nil {
+		return err
+	}
+	return tx.st.unmarshal(rec, ptr)
+}
+
+// returns the record the transaction sees for a key
+func (tx *Tx) get(k []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	if o, ok := tx.writes[string(k)]; ok {
+		if o.rec == nil {
+			return nil, ErrNotFound
+		}
+		return o.rec, nil
+	}
+	tx.st.RLock()
+	rec, err := tx.st.read(k, tx.ts)
+	if tx.st.closed {
+		err = ErrClosed
+	}
+	tx.st.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, ErrNotFound
+	}
+	return rec, nil
+}
+
+// Set adds or updates a key value pair when the transaction commits.
+func (tx *Tx) Set(k []byte, v interface{}) error {
+	if err := tx.writeable(); err != nil {
+		return err
+	}
+	rec, err := tx.st.record(k, v)
+	if err != nil {
+		return err
+	}
+	tx.put(&op{key: append([]byte(nil), k...), rec: rec})
+	return nil
+}
+
+// Del removes a key when the transaction commits.
+func (tx *Tx) Del(k []byte) error {
+	if err := tx.writeable(); err != nil {
+		return err
+	}
+	tx.put(&op{key: append([]byte(nil), k...)})
+	return nil
+}
+
+func (tx *Tx) writeable() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxRead
+	}
+	return nil
+}
+
+func (tx *Tx) put(o *op) {
+	if prev, ok := tx.writes[string(o.key)]; ok {
+		prev.rec = o.rec
+		return
+	}
+	tx.writes[string(o.key)] = o
+	tx.order = append(tx.order, o)
+}
+
+func (tx *Tx) commit() error {
+	if len(tx.order) == 0 {
+		return nil
+	}
+	tx.st.Lock()
+	defer tx.st.Unlock()
+	if tx.st.closed {
+		return ErrClosed
+	}
+	// first committer wins
+	for _, o := range tx.order {
+		if tx.st.replaced(o.key, tx.ts) != nil {
+			return ErrConflict
+		}
+	}
+	return tx.st.commit(tx.order)
+}
+
+func (tx *Tx) close() {
+	if !tx.done {
+		tx.st.release(tx.ts)
+	}
+	tx.done = true
+	tx.writes, tx.order = nil, nil
+}
+
+// Cursor walks the keys in a transaction's snapshot in order, including
+// the transaction's own pending changes. It is only valid for as long
+// as the transaction is.
+type Cursor struct {
+	tx  *Tx
+	key []byte
+}
+
+// Cursor returns a new cursor for the transaction.
+func (tx *Tx) Cursor() *Cursor {
+	return &Cursor{tx: tx}
+}
+
+// First moves to the first key and returns it, or nil if there are none.
+func (c *Cursor) First() []byte {
+	return c.Seek(nil)
+}
+
+// Seek moves to the first key greater than or equal
+// to k and returns it, or nil if there are none.
+func (c *Cursor) Seek(k []byte) []byte {
+	c.key = c.tx.seek(k)
+	return c.key
+}
+
+// Next moves to the key after the current one and
+// returns it, or nil once there are no more keys.
+func (c *Cursor) Next() []byte {
+	if c.key == nil {
+		return nil
+	}
+	// the smallest possible key after the current one
+	return c.Seek(append(append([]byte(nil), c.key...), 0x00))
+}
+
+// Key returns the current key, or nil.
+func (c *Cursor) Key() []byte {
+	return c.key
+}
+
+// Value decodes the value for the current key into ptr.
+func (c *Cursor) Value(ptr interface{}) error {
+	if c.key == nil {
+		return ErrNotFound
+	}
+	return c.tx.Get(c.key, ptr)
+}
+
+// returns the first key visible to the transaction that is
+// greater than or equal to k, merging its pending changes
+// with what the store holds
+func (tx *Tx) seek(k []byte) []byte {
+	if tx.done {
+		return nil
+	}
+	tx.st.RLock()
+	defer tx.st.RUnlock()
+	if tx.st.closed {
+		return nil
+	}
+	for {
+		var key []byte
+		if r := tx.st.index.Seek(k); r != nil {
+			key = r.Key
+		}
+		// keys deleted since the snapshot was taken, and pending
+		// writes, may come before the next key in the index
+		less := func(b []byte) bool {
+			return bytes.Compare(b, k) >= 0 && (key == nil || bytes.Compare(b, key) < 0)
+		}
+		for h := range tx.st.history {
+			if less([]byte(h)) {
+				key = []byte(h)
+			}
+		}
+		for _, o := range tx.order {
+			if o.rec != nil && less(o.key) {
+				key = o.key
+			}
+		}
+		if key == nil {
+			return nil
+		}
+		// skip over keys the snapshot can't see, or the transaction deleted
+		if o, ok := tx.writes[string(key)]; ok && o.rec != nil || !ok && tx.st.visible(key, tx.ts) {
+			return append([]byte(nil), key...)
+		}
+		k = append(append([]byte(nil), key...), 0x00)
+	}
+}
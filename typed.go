@@ -0,0 +1,84 @@
+package idx
+
+// TypedStore is a Store holding values of a single type. It encodes
+// and decodes values with the store's codec, just like the Store
+// methods do, but is checked by the compiler instead of at runtime.
+type TypedStore[T any] struct {
+	st *Store
+}
+
+// NewTypedStore returns a TypedStore holding values of type T in st.
+func NewTypedStore[T any](st *Store) *TypedStore[T] {
+	return &TypedStore[T]{st: st}
+}
+
+// Store returns the underlying store.
+func (ts *TypedStore[T]) Store() *Store {
+	return ts.st
+}
+
+// Get returns the value for a key, or ErrNotFound.
+func (ts *TypedStore[T]) Get(k []byte) (T, error) {
+	var v T
+	ts.st.RLock()
+	if ts.st.closed {
+		ts.st.RUnlock()
+		return v, ErrClosed
+	}
+	rec, err := ts.st.current(k)
+	expired := ts.st.expired(k)
+	ts.st.RUnlock()
+	if err != nil {
+		return v, err
+	}
+	if rec == nil || expired {
+		return v, ErrNotFound
+	}
+	err = ts.st.value(rec, &v)
+	return v, err
+}
+
+// Put adds or updates the value for a key.
+func (ts *TypedStore[T]) Put(k []byte, v T) error {
+	return ts.st.Set(k, v)
+}
+
+// Del removes a key.
+func (ts *TypedStore[T]) Del(k []byte) error {
+	return ts.st.Del(k)
+}
+
+// Scan calls fn for every key value pair in key order until fn returns
+// false. It reads from a consistent snapshot of the store, so writes
+// made while the scan runs are not seen by it and aren't held up.
+func (ts *TypedStore[T]) Scan(fn func(k []byte, v T) bool) error {
+	ts.st.RLock()
+	if ts.st.closed {
+		ts.st.RUnlock()
+		return ErrClosed
+	}
+	done := ts.st.scanning()
+	ts.st.RUnlock()
+	defer func() {
+		ts.st.RLock()
+		done()
+		ts.st.RUnlock()
+	}()
+	return ts.st.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		for k := c.First(); k != nil; k = c.Next() {
+			rec, err := tx.get(k)
+			if err != nil {
+				return err
+			}
+			var v T
+			if err := ts.st.value(rec, &v); err != nil {
+				return err
+			}
+			if !fn(k, v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
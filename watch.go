@@ -0,0 +1,238 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// EventOp is the kind of change an Event reports.
+type EventOp int
+
+const (
+	EventSet EventOp = iota + 1 // a key was added or updated
+	EventDel                    // a key was deleted
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	}
+	return "?"
+}
+
+// Event is a change made to a store, as delivered by Watch. Values are
+// encoded with the store's codec, or as JSON for stores without one,
+// and can be decoded with Decode.
+type Event struct {
+	Seq uint64 // numbers events in the order they were committed; see WatchFrom
+	Op  EventOp
+	Key []byte
+	Old []byte // value before the change, nil if the key was new
+	New []byte // value after the change, nil if it was deleted
+}
+
+// Overflow decides what happens to a Watch subscriber that has fallen
+// so far behind that its buffer is full. Writers never wait for one.
+type Overflow int
+
+const (
+	// OverflowClose closes the subscriber's channel, so it can catch
+	// up with WatchFrom, starting after the last event it received.
+	OverflowClose Overflow = iota
+
+	// OverflowDrop drops events until there is room for more; the
+	// subscriber sees a gap in the sequence numbers.
+	OverflowDrop
+)
+
+// default number of events buffered for each subscriber
+const DefaultWatchBuffer = 256
+
+// a Watch subscriber
+type watcher struct {
+	prefix []byte
+	ch     chan Event
+}
+
+// Watch returns a channel that receives an Event for every change
+// committed to a key starting with prefix from now on, in commit order;
+// a nil prefix watches every key. Each subscriber has a buffer of
+// Options.WatchBuffer events, and one that falls further behind is
+// dealt with according to Options.WatchOverflow. The channel is closed
+// by Unwatch and when the store is closed. Restoring a backup replaces
+// the store's contents without sending any events.
+func (st *Store) Watch(prefix []byte) <-chan Event {
+	st.Lock()
+	defer st.Unlock()
+	return st.watch(prefix, nil)
+}
+
+// WatchFrom is like Watch, but first sends every change made after the
+// event numbered seq that the store's change log still holds, so a
+// subscriber can pick up where it left off. It fails with ErrSeqGone
+// if the log no longer holds all of them; see Options.ChangeLog.
+// Sequence numbers go up by one with each event, carrying on from the
+// clock whenever the store is opened, so a number saved before then
+// fails with ErrSeqGone rather than replaying the wrong events.
+func (st *Store) WatchFrom(prefix []byte, seq uint64) (<-chan Event, error) {
+	st.Lock()
+	defer st.Unlock()
+	if st.closed {
+		return nil, ErrClosed
+	}
+	if seq > st.seq {
+		return nil, ErrSeqGone
+	}
+	if seq < st.seq {
+		if len(st.changes) == 0 || st.changes[0].Seq > seq+1 {
+			return nil, ErrSeqGone
+		}
+	}
+	var replay []Event
+	for _, e := range st.changes {
+		if e.Seq > seq && bytes.HasPrefix(e.Key, prefix) {
+			replay = append(replay, e)
+		}
+	}
+	return st.watch(prefix, replay), nil
+}
+
+// must hold the lock
+func (st *Store) watch(prefix []byte, replay []Event) <-chan Event {
+	w := &watcher{
+		prefix: append([]byte(nil), prefix...),
+		ch:     make(chan Event, st.opts.WatchBuffer+len(replay)),
+	}
+	for _, e := range replay {
+		w.ch <- e
+	}
+	if st.closed {
+		close(w.ch)
+		return w.ch
+	}
+	st.watchers[w.ch] = w
+	return w.ch
+}
+
+// Unwatch stops sending events to a channel returned by Watch or
+// WatchFrom and closes it. Events already buffered can still be read.
+func (st *Store) Unwatch(ch <-chan Event) {
+	st.Lock()
+	defer st.Unlock()
+	for c, w := range st.watchers {
+		if (<-chan Event)(c) == ch {
+			delete(st.watchers, c)
+			close(w.ch)
+		}
+	}
+}
+
+// Decode decodes a value from an Event into ptr with the store's
+// codec. Events hold just the value, so in stores without a codec
+// this is not the [key, value] array Get returns.
+func (st *Store) Decode(data []byte, ptr interface{}) error {
+	if st.codec == nil {
+		return decode(data, ptr)
+	}
+	return st.codec.Unmarshal(data, ptr)
+}
+
+// reports whether anything needs to hear about changes
+func (st *Store) watched() bool {
+	return len(st.watchers) > 0 || st.opts.ChangeLog > 0
+}
+
+// the events a set of changes will produce, worked out before they
+// are applied; must hold the lock
+func (st *Store) events(ops []*op) ([]Event, error) {
+	evs := make([]Event, 0, len(ops))
+	last := make(map[string][]byte) // records written earlier in ops
+	for _, o := range ops {
+		old, ok := last[string(o.key)]
+		if !ok {
+			var err error
+			if old, err = st.current(o.key); err != nil {
+				return nil, err
+			}
+		}
+		last[string(o.key)] = o.rec
+		if old == nil && o.rec == nil {
+			continue // deleted a key that wasn't there
+		}
+		e := Event{Op: EventSet, Key: append([]byte(nil), o.key...)}
+		if o.rec == nil {
+			e.Op = EventDel
+		}
+		var err error
+		if e.Old, err = st.raw(old); err != nil {
+			return nil, err
+		}
+		if e.New, err = st.raw(o.rec); err != nil {
+			return nil, err
+		}
+		evs = append(evs, e)
+	}
+	return evs, nil
+}
+
+// number committed events, add them to the change log and send them
+// to their subscribers; must hold the lock
+func (st *Store) publish(evs []Event) {
+	for _, e := range evs {
+		st.seq++
+		e.Seq = st.seq
+		if st.opts.ChangeLog > 0 {
+			if len(st.changes) == st.opts.ChangeLog {
+				st.changes = st.changes[1:]
+			}
+			st.changes = append(st.changes, e)
+		}
+		for c, w := range st.watchers {
+			if !bytes.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- e:
+			default:
+				if st.opts.WatchOverflow == OverflowClose {
+					delete(st.watchers, c)
+					close(w.ch)
+				}
+			}
+		}
+	}
+}
+
+// the encoded value held by a record, or nil
+func (st *Store) raw(rec []byte) ([]byte, error) {
+	if rec == nil {
+		return nil, nil
+	}
+	doc, err := st.unframe(rec)
+	if err != nil {
+		return nil, err
+	}
+	if st.codec != nil {
+		_, val, err := unpack(doc)
+		return append([]byte(nil), val...), err
+	}
+	var kv []json.RawMessage
+	if err := json.Unmarshal(doc, &kv); err != nil {
+		return nil, err
+	}
+	if len(kv) < 2 {
+		return nil, ErrBadRecord
+	}
+	return append([]byte(nil), kv[1]...), nil
+}
+
+// close every subscriber's channel; must hold the lock
+func (st *Store) unwatchAll() {
+	for c, w := range st.watchers {
+		delete(st.watchers, c)
+		close(w.ch)
+	}
+}